@@ -0,0 +1,159 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// AccountingMode 决定cache 统计nBytes 时每个entry 的计算方式
+type AccountingMode uint8
+
+const (
+	// AccountingPayload 只计算 len(key) + Value.Len()，也是最早版本的计算方式
+	AccountingPayload AccountingMode = iota
+
+	// AccountingOverhead 在payload 的基础上加上每个entry 固定的额外开销：sds 结构体、
+	// 链表节点以及map bucket 中的槽位
+	AccountingOverhead
+
+	// AccountingDeep 在AccountingOverhead 的基础上，通过反射估算Value 的真实占用，
+	// 适用于Value.Len() 不能反映真实内存的自定义结构体，代价是每次set 都需要遍历一次value
+	AccountingDeep
+)
+
+// map 的一个bucket 存放8个kv 和8个tophash，平均装载因子是6.5，这里按照每个entry
+// 分摊的 key(string header) + value(*list.Element) + tophash 估算
+const mapEntryOverhead = int((unsafe.Sizeof("") + unsafe.Sizeof(uintptr(0)) + 1) * 8 / 6)
+
+// entryOverhead 每个entry 除了key 和value 之外的固定开销
+var entryOverhead = int(unsafe.Sizeof(sds{})+unsafe.Sizeof(list.Element{})) + mapEntryOverhead
+
+// sizeOf 根据当前的统计方式计算一个entry 需要占用的字节数
+func (c *cacheImpl) sizeOf(key string, value Value) int {
+	switch c.accounting {
+	case AccountingOverhead:
+		return len(key) + value.Len() + entryOverhead
+	case AccountingDeep:
+		return len(key) + DeepSize(value) + entryOverhead
+	default:
+		return len(key) + value.Len()
+	}
+}
+
+// DeepSize 通过反射估算v 占用的内存，会跟随指针、slice、map、interface 进行递归，同一个
+// 指针只会被计算一次。map 的内部结构无法精确获取，这里按照kv 的大小加上bucket 开销估算
+func DeepSize(v interface{}) int {
+	if v == nil {
+		return 0
+	}
+	visited := map[uintptr]struct{}{}
+	rv := reflect.ValueOf(v)
+	return int(rv.Type().Size()) + deepSize(rv, visited)
+}
+
+// deepSize 只计算v 间接引用的内存，v 本身的大小由调用者计算
+func deepSize(v reflect.Value, visited map[uintptr]struct{}) int {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return 0
+		}
+		if _, ok := visited[v.Pointer()]; ok {
+			return 0
+		}
+		visited[v.Pointer()] = struct{}{}
+		elem := v.Elem()
+		return int(elem.Type().Size()) + deepSize(elem, visited)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		elem := v.Elem()
+		return int(elem.Type().Size()) + deepSize(elem, visited)
+	case reflect.String:
+		return v.Len()
+	case reflect.Slice:
+		if v.IsNil() {
+			return 0
+		}
+		if _, ok := visited[v.Pointer()]; ok {
+			return 0
+		}
+		visited[v.Pointer()] = struct{}{}
+		size := v.Cap() * int(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			size += deepSize(v.Index(i), visited)
+		}
+		return size
+	case reflect.Array:
+		size := 0
+		for i := 0; i < v.Len(); i++ {
+			size += deepSize(v.Index(i), visited)
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() {
+			return 0
+		}
+		if _, ok := visited[v.Pointer()]; ok {
+			return 0
+		}
+		visited[v.Pointer()] = struct{}{}
+		kvSize := int(v.Type().Key().Size()+v.Type().Elem().Size()) + 1
+		size := v.Len() * kvSize * 8 / 6
+		iter := v.MapRange()
+		for iter.Next() {
+			size += deepSize(iter.Key(), visited) + deepSize(iter.Value(), visited)
+		}
+		return size
+	case reflect.Struct:
+		size := 0
+		for i := 0; i < v.NumField(); i++ {
+			size += deepSize(v.Field(i), visited)
+		}
+		return size
+	default:
+		return 0
+	}
+}
+
+// SelfCheck 从头重新计算所有entry 占用的字节数，返回记录值与实际值之间的偏差(记录值 - 实际值)，
+// 同时将nBytes 修正为实际值。当Value.Len() 在写入之后发生了变化，或者统计出现漏洞的时候，
+// 这里可以发现并纠正
+func (c *cacheImpl) SelfCheck() int64 {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	var actual int64
+	for _, ns := range c.nsList {
+		ns.nBytes = 0
+	}
+	for _, v := range c.cache {
+		sd := v.Value.(*sds)
+		sd.size = c.sizeOf(sd.key, sd.Value)
+		actual += int64(sd.size)
+		if sd.ns != nil {
+			sd.ns.nBytes += int64(sd.size)
+		}
+	}
+	drift := c.nBytes - actual
+	if drift != 0 {
+		fmt.Printf("sCache : self check found drift %v byte , recorded %v ,actual %v \n\r", drift, c.nBytes, actual)
+	}
+	c.nBytes = actual
+	return drift
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrAdmissionRejected = errors.New("sCache : write rejected by admission filter")
+
+// Admission 准入策略，当写入一个新的key 需要淘汰旧的key 的时候，由准入策略决定是否允许写入，
+// 防止只访问一次的数据把热点数据挤出去
+type Admission interface {
+	// Record 记录一次key 的访问，读写都会调用，实现需要是并发安全的
+	Record(key string)
+
+	// Admit 写入candidate 需要淘汰victim 的时候调用，返回false 的时候拒绝本次写入
+	Admit(candidate, victim string) bool
+}
+
+const (
+	sketchDepth   = 4
+	sketchMaxHits = 15
+)
+
+// 每一行sketch 使用不同的种子打散hash
+var sketchSeeds = [sketchDepth]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// tinyLFU 使用count-min sketch 估算key 的访问频率，doorkeeper 是一个布隆过滤器，只有第二次
+// 访问的key 才会进入sketch，避免大量只访问一次的key 占满计数器。访问次数达到sampleSize 的
+// 时候所有计数器减半并清空doorkeeper，让频率随时间衰减
+type tinyLFU struct {
+	mu sync.Mutex
+
+	width    uint64
+	counters [sketchDepth][]uint8
+	door     []uint64
+
+	additions  int
+	sampleSize int
+}
+
+// NewTinyLFU 创建一个TinyLFU 准入策略，capacity 是预估的cache entry 数量
+func NewTinyLFU(capacity int) Admission {
+	if capacity < 16 {
+		capacity = 16
+	}
+	width := uint64(1)
+	for width < uint64(capacity) {
+		width <<= 1
+	}
+	t := &tinyLFU{
+		width:      width,
+		door:       make([]uint64, width*4/64),
+		sampleSize: capacity * 10,
+	}
+	for i := range t.counters {
+		t.counters[i] = make([]uint8, width)
+	}
+	return t
+}
+
+func (t *tinyLFU) Record(key string) {
+	h := hashKey(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.doorAdd(h) {
+		t.increment(h)
+	}
+	t.additions++
+	if t.additions >= t.sampleSize {
+		t.reset()
+	}
+}
+
+func (t *tinyLFU) Admit(candidate, victim string) bool {
+	ch, vh := hashKey(candidate), hashKey(victim)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.estimate(ch) > t.estimate(vh)
+}
+
+// doorAdd 将key 加入doorkeeper，如果key 之前已经存在返回true
+func (t *tinyLFU) doorAdd(h uint64) bool {
+	bits := uint64(len(t.door)) * 64
+	exist := true
+	for i := uint64(0); i < 3; i++ {
+		idx := (h + i*(h>>32|1)) % bits
+		if t.door[idx/64]&(1<<(idx%64)) == 0 {
+			exist = false
+			t.door[idx/64] |= 1 << (idx % 64)
+		}
+	}
+	return exist
+}
+
+func (t *tinyLFU) doorContains(h uint64) bool {
+	bits := uint64(len(t.door)) * 64
+	for i := uint64(0); i < 3; i++ {
+		idx := (h + i*(h>>32|1)) % bits
+		if t.door[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *tinyLFU) increment(h uint64) {
+	for i := range t.counters {
+		idx := t.index(h, i)
+		if t.counters[i][idx] < sketchMaxHits {
+			t.counters[i][idx]++
+		}
+	}
+}
+
+func (t *tinyLFU) estimate(h uint64) int {
+	min := uint8(sketchMaxHits)
+	for i := range t.counters {
+		if v := t.counters[i][t.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	est := int(min)
+	if t.doorContains(h) {
+		est++
+	}
+	return est
+}
+
+func (t *tinyLFU) index(h uint64, row int) uint64 {
+	h = (h ^ sketchSeeds[row]) * 0x9e3779b97f4a7c15
+	return (h >> 32) & (t.width - 1)
+}
+
+func (t *tinyLFU) reset() {
+	for i := range t.counters {
+		for j := range t.counters[i] {
+			t.counters[i][j] >>= 1
+		}
+	}
+	for i := range t.door {
+		t.door[i] = 0
+	}
+	t.additions = 0
+}
+
+// hashKey fnv-1a 64，不产生内存分配
+func hashKey(key string) uint64 {
+	var h uint64 = 14695981039346656037
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestTinyLFU(t *testing.T) {
+	Convey("test tinyLFU frequency estimate ", t, func() {
+		lfu := NewTinyLFU(100).(*tinyLFU)
+		for i := 0; i < 10; i++ {
+			lfu.Record("hot")
+		}
+		lfu.Record("cold")
+		So(lfu.estimate(hashKey("hot")), ShouldBeGreaterThanOrEqualTo, 9)
+		So(lfu.estimate(hashKey("cold")), ShouldEqual, 1)
+		So(lfu.estimate(hashKey("never")), ShouldEqual, 0)
+		So(lfu.Admit("hot", "cold"), ShouldBeTrue)
+		So(lfu.Admit("cold", "hot"), ShouldBeFalse)
+
+		Convey("reset should halve the counters ", func() {
+			lfu.reset()
+			So(lfu.estimate(hashKey("hot")), ShouldBeBetweenOrEqual, 4, 5)
+			So(lfu.estimate(hashKey("cold")), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestCacheImpl_Admission(t *testing.T) {
+	Convey("test admission reject one-hit wonders ", t, func() {
+		ca := New(5000, 10*time.Second, nil, WithMaxEntries(2), WithAdmission(NewTinyLFU(100)))
+		ca.Set("hot1", StringValue("v1"))
+		ca.Set("hot2", StringValue("v2"))
+		for i := 0; i < 5; i++ {
+			ca.Get("hot1")
+			ca.Get("hot2")
+		}
+		err := ca.Set("once", StringValue("v3"))
+		So(err, ShouldEqual, ErrAdmissionRejected)
+		So(ca.Stats().Rejections, ShouldEqual, 1)
+		So(ca.Stats().Entries, ShouldEqual, 2)
+
+		Convey("a key accessed frequently should be admitted ", func() {
+			for i := 0; i < 10; i++ {
+				ca.Get("popular")
+			}
+			So(ca.Set("popular", StringValue("v4")), ShouldBeNil)
+			val, _ := ca.Get("popular")
+			So(val, ShouldNotBeNil)
+		})
+
+		Convey("overwrite should never be rejected ", func() {
+			So(ca.Set("hot1", StringValue("new")), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchWindow = 2 * time.Millisecond
+	defaultBatchSize   = 100
+
+	// defaultBatchNegativeTTL 永不过期的批量regulation 负缓存的秒数
+	defaultBatchNegativeTTL = 60
+)
+
+// WithBatch 设置RegisterBatch 收集未命中的key 的时间窗口以及一次加载的最大key 数量，默认为2ms 和100
+func WithBatch(window time.Duration, maxSize int) RegulationOption {
+	return func(o *RegulationOptions) {
+		o.BatchWindow = window
+		o.BatchSize = maxSize
+	}
+}
+
+func (c *cacheImpl) RegisterBatch(expr string, expire int, load func(ctx context.Context, keys []string) (map[string]Value, error), opts ...RegulationOption) {
+	if expr == "" || load == nil || expire < 0 {
+		panic(ErrInValidParam)
+	}
+	var o RegulationOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// 批量加载结果中没有的key 默认负缓存expire 秒，expire 为0 的时候负缓存defaultBatchNegativeTTL 秒
+	if o.NegativeTTL == 0 {
+		ttl := expire
+		if ttl == 0 {
+			ttl = defaultBatchNegativeTTL
+		}
+		opts = append(opts, WithNegativeTTL(ttl))
+	}
+	opts = append(opts, func(o *RegulationOptions) {
+		o.batch = true
+	})
+	// 一个批次只占用一个并发许可，而不是每个key 一个
+	weight := (&regular{opts: o}).weight()
+	b := newBatcher(load, o.BatchWindow, o.BatchSize, func(ctx context.Context) (func(), error) {
+		return c.bulkheads.acquire(ctx, o.Group, weight)
+	})
+	c.regularManger.RegisterPattern(expr, expire, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+		return b.get(ctx, key)
+	}, opts...)
+}
+
+func (c *cacheImpl) MGet(ctx context.Context, keys ...string) (map[string]Value, error) {
+	if ctx == nil {
+		return nil, ErrInValidParam
+	}
+	res := make(map[string]Value, len(keys))
+	var first error
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	record := func(key string, v Value, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			return
+		}
+		if v != nil {
+			res[key] = v
+		}
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if val, ok, err := c.detect(key); ok {
+			record(key, val, err)
+			continue
+		}
+		// 未命中的key 并发加载，同一个批量regulation 的key 会在同一个时间窗口内合并成一次调用
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			v, err := c.load(ctx, key)
+			record(key, v, err)
+		}(key)
+	}
+	wg.Wait()
+	return res, first
+}
+
+// batcher 将一个时间窗口内的多个key 合并成一次批量加载，每个key 的加载依然通过singleFlight 去重
+type batcher struct {
+	load   func(ctx context.Context, keys []string) (map[string]Value, error)
+	window time.Duration
+	size   int
+
+	// acquire 批次执行之前获取并发许可
+	acquire func(ctx context.Context) (func(), error)
+
+	mu  sync.Mutex
+	cur *batch
+}
+
+// batch 一次批量加载，keys 收集完之后只读
+type batch struct {
+	keys   []string
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+
+	// 还在等待结果的key 的数量，由batcher 的锁保护，降为0的时候取消加载
+	refs int
+
+	done chan struct{}
+	vals map[string]Value
+	err  error
+}
+
+func newBatcher(load func(ctx context.Context, keys []string) (map[string]Value, error), window time.Duration, size int, acquire func(ctx context.Context) (func(), error)) *batcher {
+	if window <= 0 {
+		window = defaultBatchWindow
+	}
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	return &batcher{load: load, window: window, size: size, acquire: acquire}
+}
+
+// get 将key 加入当前的批次并等待批次的结果，结果中没有key 的时候返回ErrNotFound
+func (b *batcher) get(ctx context.Context, key string) (Value, error) {
+	b.mu.Lock()
+	bt := b.cur
+	if bt == nil {
+		// 批量加载保留第一个key 的ctx 中的值
+		loadCtx, cancel := context.WithCancel(detach(ctx))
+		bt = &batch{ctx: loadCtx, cancel: cancel, done: make(chan struct{})}
+		bt.timer = time.AfterFunc(b.window, func() {
+			b.dispatch(bt)
+		})
+		b.cur = bt
+	}
+	bt.keys = append(bt.keys, key)
+	bt.refs++
+	if len(bt.keys) >= b.size {
+		b.cur = nil
+		bt.timer.Stop()
+		go b.run(bt)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-bt.done:
+		if bt.err != nil {
+			return nil, bt.err
+		}
+		if v := bt.vals[key]; v != nil {
+			return v, nil
+		}
+		return nil, ErrNotFound
+	case <-ctx.Done():
+		b.mu.Lock()
+		bt.refs--
+		if bt.refs == 0 {
+			// 批次还在收集key 的时候需要摘下来，之后的key 加入新的批次而不是已经取消的批次
+			if b.cur == bt {
+				b.cur = nil
+				bt.timer.Stop()
+			}
+			bt.cancel()
+		}
+		b.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch 时间窗口结束，批次还没有因为达到最大数量被发出的时候发出批次
+func (b *batcher) dispatch(bt *batch) {
+	b.mu.Lock()
+	if b.cur != bt {
+		b.mu.Unlock()
+		return
+	}
+	b.cur = nil
+	b.mu.Unlock()
+	b.run(bt)
+}
+
+func (b *batcher) run(bt *batch) {
+	defer close(bt.done)
+	defer bt.cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			bt.err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	if b.acquire != nil {
+		release, err := b.acquire(bt.ctx)
+		if err != nil {
+			bt.err = err
+			return
+		}
+		defer release()
+	}
+	bt.vals, bt.err = b.load(bt.ctx, bt.keys)
+}
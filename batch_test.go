@@ -0,0 +1,163 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_RegisterBatch(t *testing.T) {
+	Convey("test coalesce misses into one batch load ", t, func() {
+		var calls atomic.Int32
+		var mu sync.Mutex
+		var batches [][]string
+		load := func(ctx context.Context, keys []string) (map[string]Value, error) {
+			calls.Inc()
+			sorted := append([]string(nil), keys...)
+			sort.Strings(sorted)
+			mu.Lock()
+			batches = append(batches, sorted)
+			mu.Unlock()
+			res := map[string]Value{}
+			for _, key := range keys {
+				// 只有偶数的id 存在
+				if id, _ := strconv.Atoi(strings.TrimPrefix(key, "item:")); id%2 == 0 {
+					res[key] = StringValue(key)
+				}
+			}
+			return res, nil
+		}
+		var keys []string
+		for i := 0; i < 10; i++ {
+			keys = append(keys, fmt.Sprintf("item:%d", i))
+		}
+
+		Convey("MGet loads all misses with one call and caches missing keys ", func() {
+			ca := New(1<<20, time.Hour, nil)
+			ca.RegisterBatch("item:{id}", 10, load, WithBatch(20*time.Millisecond, 100))
+			res, err := ca.MGet(context.Background(), keys...)
+			So(err, ShouldBeNil)
+			So(len(res), ShouldEqual, 5)
+			So(res["item:4"].(*DefaultStringValue).Value(), ShouldEqual, "item:4")
+			So(calls.Load(), ShouldEqual, 1)
+			So(len(batches[0]), ShouldEqual, 10)
+
+			v, err := ca.Get("item:1")
+			So(err, ShouldBeNil)
+			So(v, ShouldBeNil)
+			res, err = ca.MGet(context.Background(), keys...)
+			So(err, ShouldBeNil)
+			So(len(res), ShouldEqual, 5)
+			So(calls.Load(), ShouldEqual, 1)
+			So(ca.Stats().NegativeHits, ShouldBeGreaterThanOrEqualTo, 5)
+		})
+
+		Convey("separate Get calls in the window are coalesced and batch size is limited ", func() {
+			ca := New(1<<20, time.Hour, nil)
+			ca.RegisterBatch("item:{id}", 10, load, WithBatch(50*time.Millisecond, 4))
+			wg := sync.WaitGroup{}
+			for _, key := range keys {
+				wg.Add(1)
+				go func(key string) {
+					defer wg.Done()
+					ca.Get(key)
+				}(key)
+			}
+			wg.Wait()
+			So(calls.Load(), ShouldEqual, 3)
+			total := 0
+			for _, b := range batches {
+				So(len(b), ShouldBeLessThanOrEqualTo, 4)
+				total += len(b)
+			}
+			So(total, ShouldEqual, 10)
+		})
+
+		Convey("batch error is returned to every key ", func() {
+			errDown := errors.New("database is down")
+			ca := New(1<<20, time.Hour, nil)
+			ca.RegisterBatch("bad:{id}", 10, func(ctx context.Context, keys []string) (map[string]Value, error) {
+				calls.Inc()
+				return nil, errDown
+			})
+			res, err := ca.MGet(context.Background(), "bad:1", "bad:2", "bad:3")
+			So(err, ShouldEqual, errDown)
+			So(len(res), ShouldEqual, 0)
+			So(calls.Load(), ShouldEqual, 1)
+		})
+
+		Convey("missing keys of never expiring batch are negative cached and misses are detected once ", func() {
+			rec := &recordAdmission{records: map[string]int{}}
+			ca := New(1<<20, time.Hour, nil, WithAdmission(rec))
+			ca.RegisterBatch("item:{id}", 0, load, WithBatch(10*time.Millisecond, 100))
+			res, err := ca.MGet(context.Background(), "item:1", "item:2")
+			So(err, ShouldBeNil)
+			So(len(res), ShouldEqual, 1)
+			// 未命中的时候查询一次，写入的时候准入策略记录一次
+			rec.mu.Lock()
+			So(rec.records["item:1"], ShouldEqual, 1)
+			So(rec.records["item:2"], ShouldEqual, 2)
+			rec.mu.Unlock()
+			err, ok := ca.(*cacheImpl).negativeGet("item:1")
+			So(ok, ShouldBeTrue)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("keys after all waiters left should join a new batch ", func() {
+			ca := New(1<<20, time.Hour, nil)
+			ca.RegisterBatch("item:{id}", 10, func(ctx context.Context, keys []string) (map[string]Value, error) {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				return load(ctx, keys)
+			}, WithBatch(100*time.Millisecond, 100))
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := ca.GetContext(ctx, "item:2")
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+
+			v, err := ca.Get("item:4")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "item:4")
+			// 被取消的加载不会被负缓存
+			v, err = ca.Get("item:2")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "item:2")
+		})
+	})
+}
+
+// recordAdmission 记录每个key 被Record 的次数，总是允许写入
+type recordAdmission struct {
+	mu      sync.Mutex
+	records map[string]int
+}
+
+func (r *recordAdmission) Record(key string) {
+	r.mu.Lock()
+	r.records[key]++
+	r.mu.Unlock()
+}
+
+func (r *recordAdmission) Admit(candidate, victim string) bool { return true }
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"go.uber.org/atomic"
+	"sync"
+	"time"
+)
+
+// LoadShedError 慢函数的排队数量已经达到上限，这次加载被直接拒绝
+type LoadShedError struct {
+	Group string // 拒绝加载的分组，全局限制的时候为空
+}
+
+func (e *LoadShedError) Error() string {
+	if e.Group == "" {
+		return "sCache : loader queue is full"
+	}
+	return fmt.Sprintf("sCache : loader queue of group %s is full", e.Group)
+}
+
+// LoaderLimit 同时执行的慢函数的限制，每个慢函数占用的权重由 WithBulkhead 设置，默认为1
+type LoaderLimit struct {
+	// MaxWeight 同时执行的慢函数的权重之和的上限
+	MaxWeight int64
+
+	// MaxQueue 排队等待的慢函数数量的上限，超过之后新的加载会返回 *LoadShedError，为0的时候不排队
+	MaxQueue int
+}
+
+// LoaderStats 慢函数并发限制的统计数据
+type LoaderStats struct {
+	Running int64         // 正在执行的慢函数的权重之和
+	Queued  int           // 正在排队的慢函数数量
+	Wait    time.Duration // 排队累计等待的时间
+	Shed    int64         // 因为排队数量达到上限被拒绝的次数
+}
+
+// bulkheads 全局以及每个分组的并发限制，慢函数需要先获取分组的许可再获取全局的许可
+type bulkheads struct {
+	global *semaphore
+	groups map[string]*semaphore
+}
+
+// acquire 获取执行慢函数的许可，返回的release 需要在慢函数执行完之后调用
+func (b *bulkheads) acquire(ctx context.Context, group string, weight int64) (func(), error) {
+	var sems []*semaphore
+	if s, ok := b.groups[group]; ok {
+		sems = append(sems, s)
+	}
+	if b.global != nil {
+		sems = append(sems, b.global)
+	}
+	for i, s := range sems {
+		if err := s.acquire(ctx, weight); err != nil {
+			for _, acquired := range sems[:i] {
+				acquired.release(weight)
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for _, s := range sems {
+			s.release(weight)
+		}
+	}, nil
+}
+
+func (b *bulkheads) stats() (LoaderStats, map[string]LoaderStats) {
+	var global LoaderStats
+	if b.global != nil {
+		global = b.global.stats()
+	}
+	groups := make(map[string]LoaderStats, len(b.groups))
+	for name, s := range b.groups {
+		groups[name] = s.stats()
+	}
+	return global, groups
+}
+
+// semaphore 带有排队上限的加权信号量，按照先来先得的顺序分配
+type semaphore struct {
+	group string
+	limit LoaderLimit
+
+	mu      sync.Mutex
+	cur     int64
+	waiters list.List
+
+	waitNanos atomic.Int64
+	shed      atomic.Int64
+}
+
+type semWaiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+func newSemaphore(group string, limit LoaderLimit) *semaphore {
+	return &semaphore{group: group, limit: limit}
+}
+
+func (s *semaphore) acquire(ctx context.Context, weight int64) error {
+	// 权重超过上限的慢函数最多独占整个信号量
+	if weight > s.limit.MaxWeight {
+		weight = s.limit.MaxWeight
+	}
+	s.mu.Lock()
+	if s.limit.MaxWeight-s.cur >= weight && s.waiters.Len() == 0 {
+		s.cur += weight
+		s.mu.Unlock()
+		return nil
+	}
+	if s.waiters.Len() >= s.limit.MaxQueue {
+		s.mu.Unlock()
+		s.shed.Inc()
+		return &LoadShedError{Group: s.group}
+	}
+	w := &semWaiter{weight: weight, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		s.waitNanos.Add(int64(time.Since(start)))
+	}()
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// 放弃的同时拿到了许可，需要归还
+			s.cur -= weight
+		default:
+			s.waiters.Remove(elem)
+		}
+		s.notify()
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *semaphore) release(weight int64) {
+	if weight > s.limit.MaxWeight {
+		weight = s.limit.MaxWeight
+	}
+	s.mu.Lock()
+	s.cur -= weight
+	s.notify()
+	s.mu.Unlock()
+}
+
+// notify 按照顺序唤醒排队的慢函数，调用者需要持有锁
+func (s *semaphore) notify() {
+	for {
+		front := s.waiters.Front()
+		if front == nil {
+			return
+		}
+		w := front.Value.(*semWaiter)
+		if s.limit.MaxWeight-s.cur < w.weight {
+			return
+		}
+		s.cur += w.weight
+		s.waiters.Remove(front)
+		close(w.ready)
+	}
+}
+
+func (s *semaphore) stats() LoaderStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return LoaderStats{
+		Running: s.cur,
+		Queued:  s.waiters.Len(),
+		Wait:    time.Duration(s.waitNanos.Load()),
+		Shed:    s.shed.Load(),
+	}
+}
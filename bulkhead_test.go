@@ -0,0 +1,148 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_LoaderLimit(t *testing.T) {
+	Convey("test limit concurrent loaders ", t, func() {
+		var running, peak atomic.Int32
+		loader := func() (Value, error) {
+			n := running.Inc()
+			for p := peak.Load(); n > p && !peak.CAS(p, n); p = peak.Load() {
+			}
+			time.Sleep(200 * time.Millisecond)
+			running.Dec()
+			return StringValue("ok"), nil
+		}
+		load := func(ca Cache, keys []string) []error {
+			errs := make([]error, len(keys))
+			wg := sync.WaitGroup{}
+			for i, key := range keys {
+				wg.Add(1)
+				go func(i int, key string) {
+					defer wg.Done()
+					_, errs[i] = ca.Get(key)
+				}(i, key)
+				// 保证排队的顺序
+				time.Sleep(5 * time.Millisecond)
+			}
+			wg.Wait()
+			return errs
+		}
+
+		Convey("global limit sheds loads when the queue is full ", func() {
+			ca := New(1<<20, time.Hour, nil, WithLoaderLimit(LoaderLimit{MaxWeight: 2, MaxQueue: 2}))
+			var keys []string
+			for i := 0; i < 6; i++ {
+				keys = append(keys, fmt.Sprintf("key%d", i))
+				ca.Register(keys[i], 10, loader, WithNegativeTTL(10))
+			}
+			errs := load(ca, keys)
+			shed := 0
+			for _, err := range errs {
+				var e *LoadShedError
+				if errors.As(err, &e) {
+					shed++
+				} else {
+					So(err, ShouldBeNil)
+				}
+			}
+			So(shed, ShouldEqual, 2)
+			So(peak.Load(), ShouldEqual, 2)
+			st := ca.Stats().Loader
+			So(st.Shed, ShouldEqual, 2)
+			So(st.Queued, ShouldEqual, 0)
+			So(st.Running, ShouldEqual, 0)
+			So(st.Wait, ShouldBeGreaterThan, 0)
+
+			// 被拒绝的加载不会被负缓存
+			_, err := ca.Get(keys[5])
+			So(err, ShouldBeNil)
+		})
+
+		Convey("group limit and weight ", func() {
+			ca := New(1<<20, time.Hour, nil,
+				WithLoaderLimit(LoaderLimit{MaxWeight: 3, MaxQueue: 10}),
+				WithLoaderGroup("db", LoaderLimit{MaxWeight: 1, MaxQueue: 10}))
+			ca.Register("db1", 10, loader, WithBulkhead("db", 1))
+			ca.Register("db2", 10, loader, WithBulkhead("db", 1))
+			ca.Register("heavy", 10, loader, WithBulkhead("", 3))
+			ca.Register("light", 10, loader)
+
+			start := time.Now()
+			errs := load(ca, []string{"db1", "db2"})
+			So(errs, ShouldResemble, []error{nil, nil})
+			So(time.Since(start), ShouldBeGreaterThan, 400*time.Millisecond)
+			So(peak.Load(), ShouldEqual, 1)
+			So(ca.Stats().LoaderGroups["db"].Wait, ShouldBeGreaterThan, 0)
+
+			start = time.Now()
+			errs = load(ca, []string{"heavy", "light"})
+			So(errs, ShouldResemble, []error{nil, nil})
+			So(time.Since(start), ShouldBeGreaterThan, 400*time.Millisecond)
+			So(peak.Load(), ShouldEqual, 1)
+		})
+
+		Convey("queued load respects caller context ", func() {
+			ca := New(1<<20, time.Hour, nil, WithLoaderLimit(LoaderLimit{MaxWeight: 1, MaxQueue: 10}))
+			ca.Register("first", 10, loader)
+			ca.Register("second", 10, loader)
+			go ca.Get("first")
+			time.Sleep(20 * time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err := ca.GetContext(ctx, "second")
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, 150*time.Millisecond)
+			time.Sleep(20 * time.Millisecond)
+			So(ca.Stats().Loader.Queued, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestCacheImpl_BatchBulkhead(t *testing.T) {
+	Convey("test batch regulation holds one permit per batch ", t, func() {
+		var calls atomic.Int32
+		ca := New(1<<20, time.Hour, nil, WithLoaderGroup("db", LoaderLimit{MaxWeight: 1}))
+		ca.RegisterBatch("user:*", 10, func(ctx context.Context, keys []string) (map[string]Value, error) {
+			calls.Inc()
+			res := make(map[string]Value, len(keys))
+			for _, key := range keys {
+				res[key] = StringValue(key)
+			}
+			return res, nil
+		}, WithBulkhead("db", 1), WithBatch(50*time.Millisecond, 10))
+
+		var keys []string
+		for i := 0; i < 5; i++ {
+			keys = append(keys, fmt.Sprintf("user:%d", i))
+		}
+		res, err := ca.MGet(context.Background(), keys...)
+		So(err, ShouldBeNil)
+		So(len(res), ShouldEqual, 5)
+		So(calls.Load(), ShouldEqual, 1)
+		So(ca.Stats().LoaderGroups["db"].Shed, ShouldEqual, 0)
+	})
+}
@@ -13,11 +13,21 @@
 
 package Scache
 
+import "context"
+
 type Cache interface {
 	// 获取到一个值，key值，当key不存在的时候返回为空，所以在get一个不存在的值的时候除了判断
 	// err !=nil  && value !=nil ,此时才算真正获取到值
 	Get(key string) (value Value, err error)
 
+	// 批量获取，返回存在的key 以及对应的值，未命中的key 会并发加载，批量regulation 的key 会被合并
+	// 成一次批量调用。有key 加载失败的时候返回第一个错误，其他key 的结果依然会返回
+	MGet(ctx context.Context, keys ...string) (map[string]Value, error)
+
+	// 同Get，需要调用慢函数的时候慢函数可以拿到ctx 中的值，ctx 结束的时候立即返回ctx.Err()，
+	// 慢函数只有在所有等待它的调用者都离开之后才会被取消
+	GetContext(ctx context.Context, key string) (value Value, err error)
+
 	// 设置一个值到缓存当中，这里值得注意的是，如果设置一个值，它的优先级是高于register 的方法
 	Set(key string, value Value) error
 
@@ -41,8 +51,96 @@ type Cache interface {
 	Expire(key string, ttl int)
 
 	// 提前将规则注册到cache中，regulation 之间是不能覆盖，否则就会报错
-	Register(regulation string, expire int, f /* slow way func */ func() (Value, error))
+	Register(regulation string, expire int, f /* slow way func */ func() (Value, error), opts ...RegulationOption)
+
+	// 同Register，慢函数可以拿到GetContext 传入的ctx，通过Get 调用的时候ctx 为context.Background()
+	RegisterContext(regulation string, expire int, f /* slow way func */ func(ctx context.Context) (Value, error), opts ...RegulationOption)
+
+	// 注册一个带有通配符的regulation，key 未命中的时候如果匹配expr 会调用load 加载，load 可以拿到
+	// 具体的key 以及 {name} 占位符匹配到的参数，例如 user:{id} 匹配 user:123 的时候params 为
+	// {"id": "123"}。* 匹配任意字符，多个expr 都匹配的时候字面字符多的优先。精确注册的regulation
+	// 优先于expr，同一个key 的并发加载会被singleFlight 合并
+	RegisterPattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), opts ...RegulationOption)
+
+	// 注册一个批量加载的pattern，在时间窗口内未命中的key 会被收集起来一次交给load 加载，load 返回的
+	// 结果中没有的key 会被负缓存，默认负缓存expire 秒，expire 为0 的时候为60 秒，可以通过WithNegativeTTL
+	// 修改。时间窗口以及
+	// 一次加载的最大key 数量通过WithBatch 设置
+	RegisterBatch(expr string, expire int, load func(ctx context.Context, keys []string) (map[string]Value, error), opts ...RegulationOption)
+
+	// 删除一个regulation 或者pattern，已经缓存的值不会被删除，正在执行的慢函数的结果不会被存储，
+	// regulation 不存在的时候返回false
+	Unregister(regulation string) bool
+
+	// 原子的替换regulation 的慢函数，正在执行的旧的慢函数会继续执行完，但结果不会被存储，invalidate
+	// 为true 的时候同时删除已经缓存的值。regulation 不存在的时候返回ErrRegulationNotExist，pattern
+	// 需要通过ReplacePattern 替换
+	Replace(regulation string, expire int, f /* slow way func */ func() (Value, error), invalidate bool, opts ...RegulationOption) error
+
+	// 同Replace，慢函数可以拿到GetContext 传入的ctx，用于替换RegisterContext 注册的regulation
+	ReplaceContext(regulation string, expire int, f /* slow way func */ func(ctx context.Context) (Value, error), invalidate bool, opts ...RegulationOption) error
+
+	// 同Replace，替换RegisterPattern 或者RegisterBatch 注册的pattern，invalidate 为true 的时候删除所有
+	// 匹配expr 的已经缓存的值以及负缓存。pattern 不存在的时候返回ErrRegulationNotExist
+	ReplacePattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), invalidate bool, opts ...RegulationOption) error
+
+	// 按照名称排序返回当前注册的所有regulation 以及pattern
+	Regulations() []RegulationInfo
+
+	// 注册一个CornJob，立即执行一次之后每flushInterval 秒执行一次，结果写入regulation 且不过期，
+	// 返回的CronJob 可以用于停止、手动触发以及查看状态
+	RegisterCron(regulation string,flushInterval int ,f /* slow way func */ func() (Value, error), opts ...CronOption) CronJob
+
+	// 同RegisterCron，按照cron 表达式调度，支持5、6 个字段的表达式以及 @daily、@every 1m 等写法
+	RegisterCronSpec(regulation string, spec string, f /* slow way func */ func() (Value, error), opts ...CronOption) CronJob
+
+	// 从头重新计算占用的内存，返回记录值与实际值之间的偏差，并将记录值修正为实际值
+	SelfCheck() int64
+
+	// 运行时调整最大entry 数量，为0的时候表示不限制，调小的时候会分批淘汰多出来的entry，
+	// 函数在缩容完成之后返回
+	SetMaxEntries(n int64)
+
+	// 运行时调整最大内存，n 必须大于0，调小的时候会分批淘汰多出来的entry，函数在缩容完成之后返回
+	SetMaxBytes(n int64)
+
+	// 获取cache 当前的统计数据
+	Stats() Stats
+
+	// 将任意对象通过Codec 编码之后存储，ttl 为0的时候表示不过期
+	SetObject(key string, obj interface{}, ttl int) error
+
+	// 获取SetObject 存储的对象并解码到dst 中，dst 需要是指针，key 不存在的时候返回ErrKeyNotExist，
+	// 编解码失败的时候返回 *CodecError
+	GetObject(key string, dst interface{}) error
+
+	// 同Register，慢函数返回任意对象，由Codec 编码之后存储
+	RegisterObject(regulation string, expire int, f /* slow way func */ func() (interface{}, error), opts ...RegulationOption)
+
+	// 设置一个值并打上标签，ttl 为0的时候表示不过期，之后可以通过InvalidateTag 批量删除。再次调用
+	// SetWithTags 会替换key 的标签，通过Set 等方法覆盖写入的时候保留原来的标签
+	SetWithTags(key string, value Value, ttl int, tags ...string) error
+
+	// 将所有带有tag 标签的key 标记为删除，返回被删除的key 的数量
+	InvalidateTag(tag string) int
+
+	// 返回带有tag 标签且还可以访问的key 的数量
+	TagCount(tag string) int
+
+	// 返回所有的标签以及每个标签下还可以访问的key 的数量
+	Tags() map[string]int
+
+	// 返回一个命名空间视图，key 会自动加上 name\x00 前缀，OnCaller 等回调拿到的是带有前缀的key。
+	// 命名空间拥有自己的配额、LRU 和统计，同时受到全局maxBytes、maxEntries 的限制
+	Namespace(name string, quota NamespaceQuota) Cache
+
+	// 删除所有的entry，在命名空间视图上调用的时候只删除这个命名空间的entry
+	Flush()
+
+	// 停止后台清理以及内存水位调节的goroutine，之后cache 依然可以读写，但过期的entry 不会再被
+	// 后台清理。命名空间和根cache 共享这些goroutine，在命名空间视图上调用的时候不做任何事情
+	Close()
 
-	// 注册一个CornJob
-	RegisterCron(regulation string,flushInterval int ,f /* slow way func */ func() (Value, error))
+	// 进程内带租约和fencing token 的锁，见 Locker
+	Locker
 }
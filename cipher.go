@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrCipherKeyNotExist = errors.New("sCache : cipher key id is not exist")
+	ErrCipherTextInvalid = errors.New("sCache : cipher text is invalid")
+)
+
+// Cipher 对缓存的值进行加解密，实现需要是并发安全的。每个entry 会记录加密时使用的keyID，
+// 轮换密钥之后旧的entry 依然可以用旧的密钥解密
+type Cipher interface {
+	// Seal 使用当前生效的密钥加密plain，aad 是不加密但是参与校验的附加数据，cache 会传入key，
+	// 防止密文被挪到其他key 下面使用
+	Seal(plain, aad []byte) (keyID uint32, sealed []byte, err error)
+
+	// Open 使用keyID 对应的密钥解密
+	Open(keyID uint32, sealed, aad []byte) ([]byte, error)
+}
+
+// AESGCMCipher 基于AES-GCM 的Cipher，密文格式为 nonce + ciphertext
+type AESGCMCipher struct {
+	rw     sync.RWMutex
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// NewAESGCMCipher 创建一个AES-GCM 的Cipher，key 的长度必须是16、24 或者32
+func NewAESGCMCipher(keyID uint32, key []byte) (*AESGCMCipher, error) {
+	a := &AESGCMCipher{keys: map[uint32]cipher.AEAD{}}
+	if err := a.Rotate(keyID, key); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Rotate 添加一个新的密钥并将其设置为当前生效的密钥，之后的写入都会使用新的密钥
+func (a *AESGCMCipher) Rotate(keyID uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	a.rw.Lock()
+	defer a.rw.Unlock()
+	a.keys[keyID] = aead
+	a.active = keyID
+	return nil
+}
+
+// Retire 删除一个不再使用的密钥，cache 中使用这个密钥加密的entry 会被当作未命中删除，有regulation 的
+// 时候重新加载，当前生效的密钥不能删除
+func (a *AESGCMCipher) Retire(keyID uint32) {
+	a.rw.Lock()
+	defer a.rw.Unlock()
+	if keyID != a.active {
+		delete(a.keys, keyID)
+	}
+}
+
+func (a *AESGCMCipher) Seal(plain, aad []byte) (uint32, []byte, error) {
+	a.rw.RLock()
+	keyID, aead := a.active, a.keys[a.active]
+	a.rw.RUnlock()
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		return 0, nil, err
+	}
+	return keyID, aead.Seal(out, out, plain, aad), nil
+}
+
+func (a *AESGCMCipher) Open(keyID uint32, sealed, aad []byte) ([]byte, error) {
+	a.rw.RLock()
+	aead, ok := a.keys[keyID]
+	a.rw.RUnlock()
+	if !ok {
+		return nil, ErrCipherKeyNotExist
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrCipherTextInvalid
+	}
+	nonce, text := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, text, aad)
+}
+
+// detect 同getDetection，同时还原压缩或者加密过的值。加密使用的密钥已经被Retire 的时候删除这个entry
+// 并当作未命中，之后通过regulation 重新加载
+func (c *cacheImpl) detect(key string) (Value, bool, error) {
+	val, ok := c.getDetection(key)
+	if !ok {
+		return nil, false, nil
+	}
+	v, err := c.unpack(key, val)
+	if err == ErrCipherKeyNotExist {
+		c.del(key, false)
+		return nil, false, nil
+	}
+	return v, true, err
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"bytes"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAESGCMCipher(t *testing.T) {
+	Convey("test aes-gcm cipher ", t, func() {
+		ci, err := NewAESGCMCipher(1, bytes.Repeat([]byte("k"), 32))
+		So(err, ShouldBeNil)
+		id, sealed, err := ci.Seal([]byte("token"), []byte("key1"))
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, 1)
+		So(bytes.Contains(sealed, []byte("token")), ShouldBeFalse)
+
+		Convey("open with the same aad ", func() {
+			plain, err := ci.Open(id, sealed, []byte("key1"))
+			So(err, ShouldBeNil)
+			So(string(plain), ShouldEqual, "token")
+		})
+		Convey("open with another aad should fail ", func() {
+			_, err := ci.Open(id, sealed, []byte("key2"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("rotate should keep the old key readable ", func() {
+			So(ci.Rotate(2, bytes.Repeat([]byte("n"), 32)), ShouldBeNil)
+			id2, _, _ := ci.Seal([]byte("token"), nil)
+			So(id2, ShouldEqual, 2)
+			plain, err := ci.Open(id, sealed, []byte("key1"))
+			So(err, ShouldBeNil)
+			So(string(plain), ShouldEqual, "token")
+
+			ci.Retire(1)
+			_, err = ci.Open(id, sealed, []byte("key1"))
+			So(err, ShouldEqual, ErrCipherKeyNotExist)
+		})
+	})
+}
+
+func TestCacheImpl_Cipher(t *testing.T) {
+	Convey("test encrypt value at rest ", t, func() {
+		ci, _ := NewAESGCMCipher(1, bytes.Repeat([]byte("k"), 16))
+		ca := New(1<<20, 10*time.Second, nil, WithCipher(ci)).(*cacheImpl)
+		ca.Set("token", StringValue("secret-token"))
+
+		Convey("value should not be stored in plaintext ", func() {
+			stored := ca.cache["token"].Value.(*sds).Value.(*packedValue)
+			So(stored.sealed, ShouldBeTrue)
+			So(bytes.Contains(stored.cot, []byte("secret-token")), ShouldBeFalse)
+			v, err := ca.Get("token")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "secret-token")
+		})
+
+		Convey("entries written before rotation should still be readable ", func() {
+			ci.Rotate(2, bytes.Repeat([]byte("n"), 16))
+			ca.Set("token2", StringValue("secret-token2"))
+			v, _ := ca.Get("token")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "secret-token")
+			v, _ = ca.Get("token2")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "secret-token2")
+		})
+
+		Convey("entries sealed with a retired key should be reloaded ", func() {
+			ca.Register("profile", 10, func() (Value, error) {
+				return StringValue("reloaded"), nil
+			})
+			ca.Set("profile", StringValue("stale"))
+			ci.Rotate(2, bytes.Repeat([]byte("n"), 16))
+			ci.Retire(1)
+
+			v, err := ca.Get("token")
+			So(err, ShouldBeNil)
+			So(v, ShouldBeNil)
+			v, err = ca.Get("profile")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "reloaded")
+			res, err := ca.MGet(context.Background(), "token", "profile")
+			So(err, ShouldBeNil)
+			So(len(res), ShouldEqual, 1)
+		})
+	})
+
+	Convey("test encrypt with compression and off heap storage ", t, func() {
+		doc := strings.Repeat("steven is handsome ", 100)
+		ci, _ := NewAESGCMCipher(7, bytes.Repeat([]byte("k"), 32))
+		ca := New(1<<20, 10*time.Second, nil, WithCipher(ci), WithCompression(64, nil),
+			WithOffHeap(OffHeapConfig{Capacity: 1 << 16, Segments: 1})).(*cacheImpl)
+		ca.Set("doc", ByteValue([]byte(doc)))
+		So(bytes.Contains(ca.offHeap.segments[0].buf, []byte("steven")), ShouldBeFalse)
+		v, err := ca.Get("doc")
+		So(err, ShouldBeNil)
+		So(string(v.(*DefaultByteValue).Value()), ShouldEqual, doc)
+	})
+}
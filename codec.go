@@ -0,0 +1,145 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrValueNotObject = errors.New("sCache : value is not a byte value written by SetObject")
+
+// Codec 将任意的go 对象编码成字节存储到cache 中，实现需要是并发安全的
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec 使用encoding/json 编解码，也是默认的Codec
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec 使用encoding/gob 编解码，interface 类型的字段需要提前gob.Register
+	GobCodec Codec = gobCodec{}
+)
+
+// CodecError 编解码失败的时候返回的错误，可以通过errors.As 获取到具体的信息
+type CodecError struct {
+	Codec string // codec 的名字
+	Key   string // 出错的key
+	Op    string // marshal 或者 unmarshal
+	Err   error
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("sCache : %s %s key %q failed : %v", e.Codec, e.Op, e.Key, e.Err)
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+func (c *cacheImpl) SetObject(key string, obj interface{}, ttl int) error {
+	if key == "" || obj == nil || ttl < 0 {
+		return ErrInValidParam
+	}
+	v, err := c.marshal(key, obj)
+	if err != nil {
+		return err
+	}
+	return c.set(key, v, ttl)
+}
+
+func (c *cacheImpl) GetObject(key string, dst interface{}) error {
+	if key == "" || dst == nil {
+		return ErrInValidParam
+	}
+	v, err := c.get(key)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return ErrKeyNotExist
+	}
+	var data []byte
+	switch val := v.(type) {
+	case *DefaultByteValue:
+		data = val.Value()
+	case *DefaultStringValue:
+		data = []byte(val.Value())
+	default:
+		return &CodecError{Codec: c.codec.Name(), Key: key, Op: "unmarshal", Err: ErrValueNotObject}
+	}
+	if err = c.codec.Unmarshal(data, dst); err != nil {
+		return &CodecError{Codec: c.codec.Name(), Key: key, Op: "unmarshal", Err: err}
+	}
+	return nil
+}
+
+func (c *cacheImpl) RegisterObject(regulation string, expire int, f /* slow way func */ func() (interface{}, error), opts ...RegulationOption) {
+	if f == nil {
+		panic(ErrInValidParam)
+	}
+	c.Register(regulation, expire, func() (Value, error) {
+		obj, err := f()
+		if err != nil {
+			return nil, err
+		}
+		return c.marshal(regulation, obj)
+	}, opts...)
+}
+
+func (c *cacheImpl) marshal(key string, obj interface{}) (Value, error) {
+	data, err := c.codec.Marshal(obj)
+	if err != nil {
+		return nil, &CodecError{Codec: c.codec.Name(), Key: key, Op: "marshal", Err: err}
+	}
+	return ByteValue(data), nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+type codecUser struct {
+	Name string
+	Age  int
+}
+
+func TestCacheImpl_Object(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		Convey("test set and get object with "+codec.Name(), t, func() {
+			ca := New(1<<20, 10*time.Second, nil, WithCodec(codec))
+			So(ca.SetObject("user", &codecUser{Name: "steven", Age: 18}, 0), ShouldBeNil)
+
+			Convey("get object should decode to dst ", func() {
+				var u codecUser
+				So(ca.GetObject("user", &u), ShouldBeNil)
+				So(u, ShouldResemble, codecUser{Name: "steven", Age: 18})
+			})
+
+			Convey("get a not exist key ", func() {
+				var u codecUser
+				So(ca.GetObject("nobody", &u), ShouldEqual, ErrKeyNotExist)
+			})
+
+			Convey("decode to a wrong type should return CodecError ", func() {
+				var wrong []int
+				err := ca.GetObject("user", &wrong)
+				var ce *CodecError
+				So(errors.As(err, &ce), ShouldBeTrue)
+				So(ce.Op, ShouldEqual, "unmarshal")
+				So(ce.Codec, ShouldEqual, codec.Name())
+			})
+
+			Convey("register object ", func() {
+				ca.RegisterObject("loaded", 0, func() (interface{}, error) {
+					return codecUser{Name: "loaded", Age: 20}, nil
+				})
+				var u codecUser
+				So(ca.GetObject("loaded", &u), ShouldBeNil)
+				So(u.Name, ShouldEqual, "loaded")
+			})
+		})
+	}
+
+	Convey("test marshal error ", t, func() {
+		ca := New(1<<20, 10*time.Second, nil)
+		err := ca.SetObject("chan", make(chan int), 0)
+		var ce *CodecError
+		So(errors.As(err, &ce), ShouldBeTrue)
+		So(ce.Op, ShouldEqual, "marshal")
+	})
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// Compressor 压缩算法，实现需要是并发安全的
+type Compressor interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// packedValue 是cache 内部存储的经过压缩或者加密的值，Len 返回处理之后的大小，所以nBytes
+// 统计的是实际存储的大小，Get 的时候会被还原成原来的 DefaultByteValue 或者 DefaultStringValue。
+// 加密的时候cot 的前4个字节是加密使用的keyID
+type packedValue struct {
+	cot        []byte
+	kind       uint8 // 原始值的类型 ringKindBytes 或者 ringKindString
+	compressed bool
+	sealed     bool
+}
+
+func (p *packedValue) Len() int {
+	return len(p.cot)
+}
+
+// pack 将超过阈值的字节类型的值进行压缩，压缩之后没有变小的时候保留原文，配置了cipher 的时候
+// 再对结果进行加密
+func (c *cacheImpl) pack(key string, value Value) (Value, error) {
+	if c.compressor == nil && c.cipher == nil {
+		return value, nil
+	}
+	data, kind, ok := offHeapPayload(value)
+	if !ok {
+		return value, nil
+	}
+	p := &packedValue{cot: data, kind: kind}
+	if c.compressor != nil && len(data) > c.compressThreshold {
+		start := time.Now()
+		out, err := c.compressor.Compress(data)
+		c.stats.compressNanos.Add(int64(time.Since(start)))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) < len(data) {
+			c.stats.compressIn.Add(int64(len(data)))
+			c.stats.compressOut.Add(int64(len(out)))
+			p.cot, p.compressed = out, true
+		}
+	}
+	if c.cipher != nil {
+		keyID, sealed, err := c.cipher.Seal(p.cot, []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		p.cot = make([]byte, 4+len(sealed))
+		binary.LittleEndian.PutUint32(p.cot, keyID)
+		copy(p.cot[4:], sealed)
+		p.sealed = true
+	}
+	if !p.compressed && !p.sealed {
+		return value, nil
+	}
+	return p, nil
+}
+
+// unpack 将压缩或者加密过的值还原
+func (c *cacheImpl) unpack(key string, value Value) (Value, error) {
+	p, ok := value.(*packedValue)
+	if !ok {
+		return value, nil
+	}
+	data := p.cot
+	if p.sealed {
+		if c.cipher == nil || len(data) < 4 {
+			return nil, ErrCipherTextInvalid
+		}
+		plain, err := c.cipher.Open(binary.LittleEndian.Uint32(data), data[4:], []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		data = plain
+	}
+	if p.compressed {
+		start := time.Now()
+		out, err := c.compressor.Decompress(data)
+		c.stats.decompressNanos.Add(int64(time.Since(start)))
+		if err != nil {
+			return nil, err
+		}
+		data = out
+	}
+	return ringValue(data, p.kind), nil
+}
+
+type flateCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewFlateCompressor 使用compress/flate 的压缩算法，level 同flate.NewWriter
+func NewFlateCompressor(level int) Compressor {
+	return &flateCompressor{level: level}
+}
+
+func (f *flateCompressor) Name() string {
+	return "flate"
+}
+
+func (f *flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := f.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, f.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer f.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+// NewGzipCompressor 使用compress/gzip 的压缩算法，level 同gzip.NewWriterLevel
+func NewGzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+func (g *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (g *gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, g.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(src); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
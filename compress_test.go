@@ -0,0 +1,102 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"compress/gzip"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressor(t *testing.T) {
+	Convey("test compressor round trip ", t, func() {
+		src := []byte(strings.Repeat(`{"name":"steven","age":18}`, 100))
+		for _, comp := range []Compressor{NewFlateCompressor(-1), NewGzipCompressor(gzip.BestSpeed)} {
+			out, err := comp.Compress(src)
+			So(err, ShouldBeNil)
+			So(len(out), ShouldBeLessThan, len(src))
+			back, err := comp.Decompress(out)
+			So(err, ShouldBeNil)
+			So(string(back), ShouldEqual, string(src))
+		}
+	})
+}
+
+func TestCacheImpl_Compression(t *testing.T) {
+	Convey("test compress value bigger than threshold ", t, func() {
+		doc := strings.Repeat(`{"name":"steven","age":18}`, 100)
+		var deleted []Value
+		ca := New(1<<20, 10*time.Second, func(key string, value Value) {
+			deleted = append(deleted, value)
+		}, WithCompression(64, nil))
+		ca.Set("big", StringValue(doc))
+		ca.Set("bytes", ByteValue([]byte(doc)))
+		ca.Set("small", StringValue("steven"))
+
+		Convey("get should return the original value ", func() {
+			v, err := ca.Get("big")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, doc)
+			v, err = ca.Get("bytes")
+			So(err, ShouldBeNil)
+			So(string(v.(*DefaultByteValue).Value()), ShouldEqual, doc)
+			v, _ = ca.Get("small")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "steven")
+		})
+
+		Convey("accounting and stats should reflect the compressed size ", func() {
+			st := ca.Stats()
+			So(st.Bytes, ShouldBeLessThan, len(doc))
+			So(st.CompressIn, ShouldEqual, 2*len(doc))
+			So(st.CompressRatio, ShouldBeLessThan, 0.2)
+			So(st.CompressTime, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("OnCaller should receive the original value ", func() {
+			ca.Del("big")
+			So(deleted[0].(*DefaultStringValue).Value(), ShouldEqual, doc)
+		})
+	})
+
+	Convey("test compression with off heap storage ", t, func() {
+		doc := strings.Repeat("steven is handsome ", 100)
+		ca := New(1<<20, 10*time.Second, nil, WithCompression(64, nil), WithOffHeap(OffHeapConfig{Capacity: 1 << 16}))
+		ca.Set("big", ByteValue([]byte(doc)))
+		v, err := ca.Get("big")
+		So(err, ShouldBeNil)
+		So(string(v.(*DefaultByteValue).Value()), ShouldEqual, doc)
+		So(ca.Stats().OffHeapBytes, ShouldBeLessThan, len(doc))
+	})
+}
+
+func TestOffHeapView_Packed(t *testing.T) {
+	Convey("test packed value in view mode is copied out of segment ", t, func() {
+		store := newOffHeapStore(OffHeapConfig{Capacity: 1024, Segments: 1, View: true})
+		store.set("packed", []byte("aaaaa"), ringKindBytes|ringFlagCompressed, 0, false)
+		store.set("raw", []byte("bbbbb"), ringKindBytes, 0, false)
+		packed, _, ok, _ := store.get("packed")
+		So(ok, ShouldBeTrue)
+		raw, _, _, _ := store.get("raw")
+
+		// 覆盖segment 中的内容，只有view 返回的原始字节会跟着变化
+		seg := store.segments[0]
+		for i := range seg.buf {
+			seg.buf[i] = 'z'
+		}
+		So(string(packed.(*packedValue).cot), ShouldEqual, "aaaaa")
+		So(string(raw.(*DefaultByteValue).Value()), ShouldEqual, "zzzzz")
+	})
+}
@@ -0,0 +1,387 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrCronSpecInvalid = errors.New("sCache : cron spec is invalid")
+
+// CronJob RegisterCron、RegisterCronSpec 返回的定时任务
+type CronJob interface {
+	// Stop 停止定时任务，正在执行的一次不会被打断，停止之后同名的定时任务可以重新注册
+	Stop()
+
+	// Trigger 立即执行一次，不影响之后的调度
+	Trigger()
+
+	// Status 返回定时任务当前的状态
+	Status() CronStatus
+}
+
+// CronStatus 定时任务的状态
+type CronStatus struct {
+	LastRun   time.Time // 最近一次开始执行的时间
+	LastError error     // 最近一次执行的错误，panic 的时候为 *PanicError
+	NextRun   time.Time // 下一次调度的时间，停止之后为零值
+	Runs      int64     // 执行的次数
+	Skipped   int64     // 因为上一次还没有执行完而被跳过的次数
+	Running   bool
+	Stopped   bool
+}
+
+// OverlapPolicy 调度时间到了但上一次还没有执行完的时候的处理方式
+type OverlapPolicy int
+
+const (
+	// OverlapSkip 跳过这一次调度
+	OverlapSkip OverlapPolicy = iota
+
+	// OverlapQueue 上一次执行完之后立即再执行一次，最多排队一次
+	OverlapQueue
+)
+
+type cronOptions struct {
+	jitter  time.Duration
+	overlap OverlapPolicy
+}
+
+// CronOption 注册定时任务时的可选配置
+type CronOption func(o *cronOptions)
+
+// WithCronJitter 启动的时候随机等待 [0, d) 再开始调度，避免大量实例同时启动时定时任务集中执行
+func WithCronJitter(d time.Duration) CronOption {
+	return func(o *cronOptions) {
+		o.jitter = d
+	}
+}
+
+// WithCronOverlap 设置执行重叠时的处理方式，默认为OverlapSkip
+func WithCronOverlap(policy OverlapPolicy) CronOption {
+	return func(o *cronOptions) {
+		o.overlap = policy
+	}
+}
+
+// schedule 根据当前时间计算下一次调度的时间
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+// everySchedule 固定间隔调度
+type everySchedule time.Duration
+
+func (e everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// cronSchedule cron 表达式调度，每个字段是一个bit 集合
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+
+	// dom 和dow 都不是 * 的时候满足任意一个即可，和标准cron 保持一致
+	domStar, dowStar bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// parseCronSpec 解析cron 表达式，支持：
+//  1. 5 个字段：分 时 日 月 周
+//  2. 6 个字段：秒 分 时 日 月 周
+//  3. @yearly、@monthly、@weekly、@daily、@hourly 以及 @every <duration>
+//
+// 每个字段支持 *、a、a-b、*/n、a-b/n 以及用 , 分隔的列表，周的取值为0-7，0 和7 都表示周日
+func parseCronSpec(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil || d <= 0 {
+			return nil, ErrCronSpecInvalid
+		}
+		return everySchedule(d), nil
+	}
+	if v, ok := cronDescriptors[spec]; ok {
+		spec = v
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, ErrCronSpecInvalid
+	}
+	s := &cronSchedule{}
+	var err error
+	bounds := [6][2]int{{0, 59}, {0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	dst := [6]*uint64{&s.second, &s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, field := range fields {
+		if *dst[i], err = parseCronField(field, bounds[i][0], bounds[i][1]); err != nil {
+			return nil, err
+		}
+	}
+	// 周日可以写成0 或者7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[3] == "*" || fields[3] == "?"
+	s.dowStar = fields[5] == "*" || fields[5] == "?"
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.IndexByte(part, '/'); idx >= 0 {
+			n, err := strconv.Atoi(part[idx+1:])
+			if err != nil || n <= 0 {
+				return 0, ErrCronSpecInvalid
+			}
+			step = n
+			part = part[:idx]
+		}
+		lo, hi := min, max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			idx := strings.IndexByte(part, '-')
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(part[:idx])
+			hi, err2 = strconv.Atoi(part[idx+1:])
+			if err1 != nil || err2 != nil {
+				return 0, ErrCronSpecInvalid
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, ErrCronSpecInvalid
+			}
+			lo, hi = n, n
+			if step != 1 {
+				// a/n 表示从a 开始到最大值每n 个
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, ErrCronSpecInvalid
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// next 返回t 之后第一个满足表达式的时间，精确到秒，5 年之内都没有满足的时间的时候返回零值
+func (s *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case s.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = time.Date(y, m, d, t.Hour(), t.Minute()+1, 0, 0, loc)
+		case s.second&(1<<uint(t.Second())) == 0:
+			t = t.Add(time.Second)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// cronJob 定时调用f 并将结果写入regulation，每次执行都会单独recover，一次panic 不会影响之后的调度
+type cronJob struct {
+	c          *cacheImpl
+	regulation string
+	f          func() (Value, error)
+	sched      schedule
+	opts       cronOptions
+
+	mu      sync.Mutex
+	status  CronStatus
+	pending bool
+
+	trigger chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func newCronJob(c *cacheImpl, regulation string, sched schedule, f func() (Value, error), opts []CronOption) *cronJob {
+	j := &cronJob{
+		c:          c,
+		regulation: regulation,
+		f:          f,
+		sched:      sched,
+		trigger:    make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&j.opts)
+	}
+	return j
+}
+
+func (j *cronJob) Stop() {
+	j.once.Do(func() {
+		close(j.stop)
+		j.mu.Lock()
+		j.status.Stopped = true
+		j.status.NextRun = time.Time{}
+		j.mu.Unlock()
+		j.c.removeCron(j)
+	})
+}
+
+func (j *cronJob) Trigger() {
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (j *cronJob) Status() CronStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// loop 调度的goroutine，immediate 为true 的时候启动之后立即执行一次
+func (j *cronJob) loop(immediate bool) {
+	if j.opts.jitter > 0 {
+		t := time.NewTimer(time.Duration(rand.Int63n(int64(j.opts.jitter))))
+		select {
+		case <-j.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+	if immediate {
+		j.fire()
+	}
+	for {
+		next := j.sched.next(time.Now())
+		if next.IsZero() {
+			if j.c.OnError != nil {
+				j.c.OnError(fmt.Sprintf("cron regulation %s has no next run", j.regulation))
+			}
+			j.Stop()
+			return
+		}
+		j.mu.Lock()
+		j.status.NextRun = next
+		j.mu.Unlock()
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-j.stop:
+			t.Stop()
+			return
+		case <-j.trigger:
+			t.Stop()
+		case <-t.C:
+		}
+		j.fire()
+	}
+}
+
+// fire 在单独的goroutine 中执行一次，上一次还没有执行完的时候按照OverlapPolicy 处理
+func (j *cronJob) fire() {
+	j.mu.Lock()
+	if j.status.Running {
+		if j.opts.overlap == OverlapQueue {
+			j.pending = true
+		} else {
+			j.status.Skipped++
+		}
+		j.mu.Unlock()
+		return
+	}
+	j.status.Running = true
+	j.mu.Unlock()
+	go j.run()
+}
+
+func (j *cronJob) run() {
+	for {
+		start := time.Now()
+		err := j.runOnce()
+		j.mu.Lock()
+		j.status.LastRun = start
+		j.status.LastError = err
+		j.status.Runs++
+		if j.pending && !j.status.Stopped {
+			j.pending = false
+			j.mu.Unlock()
+			continue
+		}
+		j.pending = false
+		j.status.Running = false
+		j.mu.Unlock()
+		return
+	}
+}
+
+func (j *cronJob) runOnce() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+			// issue error #9
+			if j.c.OnError != nil {
+				j.c.OnError(fmt.Sprintf("regulation is %s", j.regulation), err)
+			}
+		}
+	}()
+	v, err := j.f()
+	if err != nil {
+		if j.c.OnError != nil {
+			j.c.OnError(err)
+		}
+		return err
+	}
+	return j.c.set(j.regulation, v, 0)
+}
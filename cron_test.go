@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCronSpec(t *testing.T) {
+	Convey("test parse cron spec and compute next run ", t, func() {
+		// 2024-01-01 是周一
+		base := time.Date(2024, 1, 1, 10, 0, 30, 0, time.UTC)
+		for spec, want := range map[string]time.Time{
+			"*/15 * * * *":     time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC),
+			"0 9 * * 1-5":      time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC),
+			"30 * * * * *":     time.Date(2024, 1, 1, 10, 1, 30, 0, time.UTC),
+			"0 0 1 1 *":        time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			"0 12 13 * 5":      time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC),
+			"0 0 * * 7":        time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC),
+			"5,40 10-11 * * *": time.Date(2024, 1, 1, 10, 5, 0, 0, time.UTC),
+			"0 0 29 2 *":       time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+			"@hourly":          time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC),
+			"@every 90s":       base.Add(90 * time.Second),
+		} {
+			sched, err := parseCronSpec(spec)
+			So(err, ShouldBeNil)
+			So(sched.next(base), ShouldEqual, want)
+		}
+		for _, spec := range []string{"61 * * * *", "* * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@every -1s"} {
+			_, err := parseCronSpec(spec)
+			So(err, ShouldEqual, ErrCronSpecInvalid)
+		}
+		sched, _ := parseCronSpec("0 0 30 2 *")
+		So(sched.next(base).IsZero(), ShouldBeTrue)
+	})
+}
+
+func TestCacheImpl_CronJob(t *testing.T) {
+	Convey("test cron job handle ", t, func() {
+		ca := New(1<<20, time.Hour, nil)
+		ca.SetErrorHandler(func(...interface{}) {})
+
+		Convey("panic in one run does not kill the schedule ", func() {
+			var runs atomic.Int32
+			job := ca.RegisterCron("panic", 1, func() (Value, error) {
+				if runs.Inc() == 1 {
+					panic("bad run")
+				}
+				return StringValue(fmt.Sprint(runs.Load())), nil
+			})
+			time.Sleep(50 * time.Millisecond)
+			_, ok := job.Status().LastError.(*PanicError)
+			So(ok, ShouldBeTrue)
+			So(job.Status().NextRun.IsZero(), ShouldBeFalse)
+
+			time.Sleep(1100 * time.Millisecond)
+			st := job.Status()
+			So(st.Runs, ShouldEqual, 2)
+			So(st.LastError, ShouldBeNil)
+			v, err := ca.Get("panic")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "2")
+
+			job.Stop()
+			So(job.Status().Stopped, ShouldBeTrue)
+			time.Sleep(1100 * time.Millisecond)
+			So(runs.Load(), ShouldEqual, 2)
+
+			// 停止之后可以重新注册
+			So(func() {
+				ca.RegisterCron("panic", 1, func() (Value, error) { return StringValue("new"), nil }).Stop()
+			}, ShouldNotPanic)
+		})
+
+		Convey("trigger and overlap policy ", func() {
+			slow := func(runs *atomic.Int32) func() (Value, error) {
+				return func() (Value, error) {
+					runs.Inc()
+					time.Sleep(200 * time.Millisecond)
+					return StringValue("done"), nil
+				}
+			}
+			var skipRuns, queueRuns atomic.Int32
+			skip := ca.RegisterCronSpec("skip", "@yearly", slow(&skipRuns))
+			queue := ca.RegisterCronSpec("queue", "@yearly", slow(&queueRuns), WithCronOverlap(OverlapQueue))
+			defer skip.Stop()
+			defer queue.Stop()
+			So(skip.Status().Runs, ShouldEqual, 0)
+
+			for _, job := range []CronJob{skip, queue} {
+				job.Trigger()
+				time.Sleep(50 * time.Millisecond)
+				job.Trigger()
+			}
+			time.Sleep(600 * time.Millisecond)
+			So(skipRuns.Load(), ShouldEqual, 1)
+			So(skip.Status().Skipped, ShouldEqual, 1)
+			So(queueRuns.Load(), ShouldEqual, 2)
+			So(queue.Status().Runs, ShouldEqual, 2)
+			v, _ := ca.Get("queue")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "done")
+
+			So(func() { ca.RegisterCronSpec("skip", "@daily", slow(&skipRuns)) }, ShouldPanicWith, ErrKeyAlreadyExist)
+			So(func() { ca.RegisterCronSpec("bad", "* *", slow(&skipRuns)) }, ShouldPanicWith, ErrCronSpecInvalid)
+		})
+	})
+}
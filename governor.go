@@ -0,0 +1,210 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cgroup v1 在没有限制的时候会返回一个接近int64 最大值的数，超过这个值认为没有限制
+const cgroupUnlimited = 1 << 62
+
+// GovernorConfig 内存水位调节器的配置，governor 会定期读取进程的堆内存以及cgroup 的内存
+// 限制和使用量，在内存紧张的时候调低cache 实际生效的maxBytes，压力下降之后再逐步恢复
+type GovernorConfig struct {
+	// 采样间隔，默认5秒
+	Interval time.Duration
+
+	// 内存使用率超过这个值的时候开始调低maxBytes，默认0.85
+	HighWatermark float64
+
+	// 内存使用率低于这个值的时候逐步恢复maxBytes，默认0.7，不小于HighWatermark 的时候为
+	// HighWatermark*0.8
+	LowWatermark float64
+
+	// 每次调整的比例，默认0.1，调低的时候为 当前值*(1-Step)，恢复的时候为 当前值*(1+Step)
+	Step float64
+
+	// 调低的时候maxBytes 不会低于这个值，默认为配置的maxBytes 的十分之一
+	MinBytes int64
+
+	// cgroup 的挂载目录，默认 /sys/fs/cgroup，同时支持v1 和v2
+	CgroupRoot string
+
+	// 没有读取到cgroup 限制的时候使用的内存上限，为0的时候没有cgroup 限制governor 不做任何调整
+	MemoryLimit int64
+}
+
+type memoryGovernor struct {
+	c   *cacheImpl
+	cfg GovernorConfig
+
+	mu sync.Mutex
+	// ceiling 用户配置的maxBytes，governor 调整的maxBytes 不会超过这个值
+	ceiling  int64
+	pressure float64
+
+	// 读取go runtime 的堆内存，测试的时候可以替换
+	readHeap func() uint64
+}
+
+func newMemoryGovernor(c *cacheImpl, cfg GovernorConfig) *memoryGovernor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.HighWatermark <= 0 {
+		cfg.HighWatermark = 0.85
+	}
+	if cfg.LowWatermark <= 0 {
+		cfg.LowWatermark = 0.7
+	}
+	if cfg.LowWatermark >= cfg.HighWatermark {
+		cfg.LowWatermark = cfg.HighWatermark * 0.8
+	}
+	if cfg.Step <= 0 || cfg.Step >= 1 {
+		cfg.Step = 0.1
+	}
+	if cfg.CgroupRoot == "" {
+		cfg.CgroupRoot = "/sys/fs/cgroup"
+	}
+	return &memoryGovernor{
+		c:        c,
+		cfg:      cfg,
+		ceiling:  c.maxBytes,
+		readHeap: readRuntimeHeap,
+	}
+}
+
+// run 在后台定期采样，done 关闭的时候退出
+func (g *memoryGovernor) run(done <-chan struct{}) {
+	go func() {
+		t := time.NewTicker(g.cfg.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				g.tick()
+			}
+		}
+	}()
+}
+
+// tick 采样一次内存使用率，并根据水位调整maxBytes
+func (g *memoryGovernor) tick() {
+	limit, usage := readCgroupMemory(g.cfg.CgroupRoot)
+	if limit <= 0 {
+		limit = g.cfg.MemoryLimit
+	}
+	if limit <= 0 {
+		return
+	}
+	if heap := int64(g.readHeap()); heap > usage {
+		usage = heap
+	}
+	pressure := float64(usage) / float64(limit)
+
+	g.mu.Lock()
+	g.pressure = pressure
+	ceiling := g.ceiling
+	g.mu.Unlock()
+	floor := g.cfg.MinBytes
+	if floor <= 0 {
+		floor = ceiling / 10
+	}
+
+	g.c.rw.RLock()
+	current := g.c.maxBytes
+	g.c.rw.RUnlock()
+
+	next := current
+	switch {
+	case pressure >= g.cfg.HighWatermark:
+		next = int64(float64(current) * (1 - g.cfg.Step))
+		if next < floor {
+			next = floor
+		}
+	case pressure <= g.cfg.LowWatermark && current < ceiling:
+		next = int64(float64(current) * (1 + g.cfg.Step))
+		if next > ceiling {
+			next = ceiling
+		}
+	}
+	if next == current || next <= 0 {
+		return
+	}
+	fmt.Printf("sCache : memory governor , pressure %.2f ,adjust maxBytes from %v to %v \n\r", pressure, current, next)
+	g.c.setMaxBytes(next)
+}
+
+func (g *memoryGovernor) setCeiling(n int64) {
+	g.mu.Lock()
+	g.ceiling = n
+	g.mu.Unlock()
+}
+
+func (g *memoryGovernor) Pressure() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pressure
+}
+
+func readRuntimeHeap() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// readCgroupMemory 读取cgroup 的内存限制以及当前使用量，优先读取v2，读取不到再读取v1，
+// 没有限制的时候limit 返回0
+func readCgroupMemory(root string) (limit, usage int64) {
+	if l, ok := readCgroupValue(filepath.Join(root, "memory.max")); ok {
+		usage, _ = readCgroupValue(filepath.Join(root, "memory.current"))
+		return l, usage
+	}
+	if l, ok := readCgroupValue(filepath.Join(root, "memory", "memory.limit_in_bytes")); ok {
+		usage, _ = readCgroupValue(filepath.Join(root, "memory", "memory.usage_in_bytes"))
+		return l, usage
+	}
+	return 0, 0
+}
+
+// readCgroupValue 读取cgroup 文件中的数值，文件不存在、内容为max 或者超过cgroupUnlimited 的
+// 时候返回0，第二个返回值表示文件是否存在
+func readCgroupValue(path string) (int64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, true
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v >= cgroupUnlimited {
+		return 0, true
+	}
+	return v, true
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCgroupFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadCgroupMemory(t *testing.T) {
+	Convey("test read cgroup memory files ", t, func() {
+		Convey("cgroup v2 ", func() {
+			root := t.TempDir()
+			writeCgroupFile(t, filepath.Join(root, "memory.max"), "1000\n")
+			writeCgroupFile(t, filepath.Join(root, "memory.current"), "300\n")
+			limit, usage := readCgroupMemory(root)
+			So(limit, ShouldEqual, 1000)
+			So(usage, ShouldEqual, 300)
+		})
+		Convey("cgroup v2 without limit ", func() {
+			root := t.TempDir()
+			writeCgroupFile(t, filepath.Join(root, "memory.max"), "max\n")
+			limit, _ := readCgroupMemory(root)
+			So(limit, ShouldEqual, 0)
+		})
+		Convey("cgroup v1 ", func() {
+			root := t.TempDir()
+			writeCgroupFile(t, filepath.Join(root, "memory", "memory.limit_in_bytes"), "2000\n")
+			writeCgroupFile(t, filepath.Join(root, "memory", "memory.usage_in_bytes"), "500\n")
+			limit, usage := readCgroupMemory(root)
+			So(limit, ShouldEqual, 2000)
+			So(usage, ShouldEqual, 500)
+		})
+		Convey("cgroup v1 without limit ", func() {
+			root := t.TempDir()
+			writeCgroupFile(t, filepath.Join(root, "memory", "memory.limit_in_bytes"), "9223372036854771712\n")
+			limit, _ := readCgroupMemory(root)
+			So(limit, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestMemoryGovernor_Tick(t *testing.T) {
+	Convey("test governor adjust maxBytes by pressure ", t, func() {
+		root := t.TempDir()
+		writeCgroupFile(t, filepath.Join(root, "memory.max"), "1000")
+		ca := New(10000, 10*time.Second, nil, WithMemoryGovernor(GovernorConfig{
+			Interval:   time.Hour,
+			Step:       0.5,
+			MinBytes:   2000,
+			CgroupRoot: root,
+		})).(*cacheImpl)
+		ca.governor.readHeap = func() uint64 { return 0 }
+
+		Convey("high pressure should lower maxBytes down to MinBytes ", func() {
+			writeCgroupFile(t, filepath.Join(root, "memory.current"), "900")
+			ca.governor.tick()
+			So(ca.Stats().MaxBytes, ShouldEqual, 5000)
+			So(ca.Stats().MemoryPressure, ShouldAlmostEqual, 0.9)
+			ca.governor.tick()
+			ca.governor.tick()
+			So(ca.Stats().MaxBytes, ShouldEqual, 2000)
+
+			Convey("low pressure should raise maxBytes back to the configured value ", func() {
+				writeCgroupFile(t, filepath.Join(root, "memory.current"), "100")
+				ca.governor.tick()
+				So(ca.Stats().MaxBytes, ShouldEqual, 3000)
+				for i := 0; i < 5; i++ {
+					ca.governor.tick()
+				}
+				So(ca.Stats().MaxBytes, ShouldEqual, 10000)
+			})
+		})
+
+		Convey("SetMaxBytes should change the ceiling ", func() {
+			writeCgroupFile(t, filepath.Join(root, "memory.current"), "100")
+			ca.SetMaxBytes(4000)
+			ca.governor.tick()
+			So(ca.Stats().MaxBytes, ShouldEqual, 4000)
+		})
+	})
+}
+
+func TestMemoryGovernor_Close(t *testing.T) {
+	Convey("test governor defaults and stop ", t, func() {
+		ca := New(10000, 10*time.Second, nil).(*cacheImpl)
+		g := newMemoryGovernor(ca, GovernorConfig{
+			Interval:    10 * time.Millisecond,
+			MemoryLimit: 1 << 40,
+			CgroupRoot:  t.TempDir(),
+		})
+		So(g.cfg.HighWatermark, ShouldEqual, 0.85)
+		So(g.cfg.LowWatermark, ShouldEqual, 0.7)
+
+		var ticks atomic.Int32
+		g.readHeap = func() uint64 {
+			ticks.Inc()
+			return 0
+		}
+		g.run(ca.done)
+		time.Sleep(50 * time.Millisecond)
+		So(ticks.Load(), ShouldBeGreaterThan, 0)
+
+		ca.Close()
+		ca.Close()
+		time.Sleep(20 * time.Millisecond)
+		stopped := ticks.Load()
+		time.Sleep(50 * time.Millisecond)
+		So(ticks.Load(), ShouldEqual, stopped)
+	})
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/atomic"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrHostFlightUnsupported 当前平台不支持文件锁，只在进程内合并请求
+var ErrHostFlightUnsupported = errors.New("sCache : host single flight is not supported on this platform")
+
+// HostFlightConfig 同一台机器上多个进程之间的singleFlight 配置。每个regulation 在Dir 下对应一个
+// 锁文件，拿到文件锁的进程执行慢函数并把结果写入结果文件，其他进程等到文件锁释放之后直接读取结果，
+// 不再重复加载。持有锁的进程退出的时候文件锁由系统释放，等待的进程会接着加载。
+//
+// 只有 DefaultByteValue、DefaultStringValue 以及不存在的结果可以在进程之间传递，其他类型的值
+// 和慢函数的错误不会写入结果文件，等待的进程会依次自己加载。结果文件只有当前用户可以读写，开启了
+// WithCipher 的时候值会以key 作为附加数据加密之后再写入，并记录使用的keyID，协作的进程需要配置
+// 同样的密钥，无法解密的结果文件当作不存在
+type HostFlightConfig struct {
+	// Dir 存放锁文件以及结果文件的目录，需要协作的进程配置同一个目录，不存在的时候会被创建，
+	// 为空的时候 WithHostSingleFlight 会panic ErrInValidParam
+	Dir string
+
+	// PollInterval 等待其他进程释放文件锁的时候检查的间隔，默认为10ms
+	PollInterval time.Duration
+}
+
+// hostFlight 基于文件锁的跨进程singleFlight，进程内依然先经过defaultSingleFlight，同一个进程
+// 对同一个key 最多只有一个请求在竞争文件锁
+type hostFlight struct {
+	dir  string
+	poll time.Duration
+
+	// 从其他进程的结果文件中拿到结果的次数
+	handoffs atomic.Int64
+
+	// 文件锁以及结果文件读写失败的时候调用，由cache 设置为OnError
+	onError func(...interface{})
+
+	// cache 的Cipher，不为nil 的时候结果文件中的值被加密
+	cipher Cipher
+
+	// key -> 本进程最近一次写入或者读取的结果文件，只接受比它更新的结果文件，否则提前刷新、
+	// stale 刷新以及Del 之后的加载会拿回本进程已经有的旧结果。结果过期之后由sweep 删除
+	seen sync.Map
+}
+
+// hostSeen 结果文件的写入时间以及过期时间，单位都是unix nano
+type hostSeen struct {
+	writtenAt int64
+	expireAt  int64
+}
+
+// newHostFlight 创建Dir 并检查当前平台是否支持文件锁，失败的时候返回错误
+func newHostFlight(cfg HostFlightConfig) (*hostFlight, error) {
+	if cfg.Dir == "" {
+		return nil, ErrInValidParam
+	}
+	if !hostFlightSupported {
+		return nil, ErrHostFlightUnsupported
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 10 * time.Millisecond
+	}
+	return &hostFlight{dir: cfg.Dir, poll: cfg.PollInterval, onError: func(...interface{}) {}}, nil
+}
+
+// hostValue 从其他进程的结果文件中拿到的值，ttl 为结果剩余的有效时间，存储的时候使用ttl 而不是
+// regulation 的过期时间，保证所有进程中的值在同一时间过期
+type hostValue struct {
+	Value
+	ttl int
+}
+
+// 结果文件的格式：魔数、写入时间(unix nano)、过期时间(unix nano ,0 表示永不过期)、值的类型、
+// key 的长度、key、值。值被加密的时候类型带有ringFlagSealed，值为 keyID(4) + 密文
+var hostFileMagic = []byte("SCHF")
+
+const (
+	hostHeaderSize       = 25
+	hostKindNil    uint8 = 0
+)
+
+// do 拿到key 对应的文件锁之后执行load，等待期间其他进程已经写入了有效的结果的时候直接返回，
+// 锁文件无法创建的时候交给onError 处理并退化为只在进程内合并请求
+func (h *hostFlight) do(ctx context.Context, key string, expire int, load func(ctx context.Context) (Value, error)) (Value, error) {
+	name := filepath.Join(h.dir, fmt.Sprintf("%016x", hashKey(key)))
+	unlock, err := lockFile(ctx, name+".lock", h.poll)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		h.onError(fmt.Sprintf("host single flight lock %s", key), err)
+		return load(ctx)
+	}
+	defer unlock()
+	if v, ok := h.read(name+".val", key); ok {
+		h.handoffs.Inc()
+		return v, nil
+	}
+	val, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// 结果文件只影响其他进程，写入失败的时候本进程拿到的值依然有效
+	if err = h.write(name, key, val, expire); err != nil {
+		h.onError(fmt.Sprintf("host single flight write %s", key), err)
+	}
+	return val, nil
+}
+
+// read 读取还在有效期内并且比本进程已有的结果更新的结果，key 不一致的时候说明是hash 冲突，
+// 当作不存在
+func (h *hostFlight) read(path string, key string) (Value, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) < hostHeaderSize || !bytes.Equal(data[:4], hostFileMagic) {
+		return nil, false
+	}
+	writtenAt := int64(binary.BigEndian.Uint64(data[4:12]))
+	expireAt := int64(binary.BigEndian.Uint64(data[12:20]))
+	kind := data[20]
+	keyLen := int(binary.BigEndian.Uint32(data[21:25]))
+	if len(data) < hostHeaderSize+keyLen || string(data[hostHeaderSize:hostHeaderSize+keyLen]) != key {
+		return nil, false
+	}
+	if last, ok := h.seen.Load(key); ok && writtenAt <= last.(hostSeen).writtenAt {
+		return nil, false
+	}
+	ttl := 0
+	if expireAt > 0 {
+		remain := time.Until(time.Unix(0, expireAt))
+		if remain <= 0 {
+			return nil, false
+		}
+		ttl = int((remain + time.Second - 1) / time.Second)
+	}
+	payload := data[hostHeaderSize+keyLen:]
+	if kind != hostKindNil {
+		var ok bool
+		if payload, ok = h.open(key, payload, kind); !ok {
+			return nil, false
+		}
+		kind &= ringKindMask
+	}
+	h.seen.Store(key, hostSeen{writtenAt: writtenAt, expireAt: expireAt})
+	if kind == hostKindNil {
+		return &hostValue{ttl: ttl}, true
+	}
+	return &hostValue{Value: ringValue(payload, kind), ttl: ttl}, true
+}
+
+// open 解密结果文件中的值，开启了加密的时候不接受明文的值
+func (h *hostFlight) open(key string, payload []byte, kind uint8) ([]byte, bool) {
+	sealed := kind&ringFlagSealed != 0
+	if h.cipher == nil || !sealed {
+		return payload, h.cipher == nil && !sealed
+	}
+	if len(payload) < 4 {
+		return nil, false
+	}
+	plain, err := h.cipher.Open(binary.BigEndian.Uint32(payload[:4]), payload[4:], []byte(key))
+	if err != nil {
+		return nil, false
+	}
+	return plain, true
+}
+
+// write 先写入临时文件再重命名，其他进程不会读到写了一半的结果
+func (h *hostFlight) write(name string, key string, val Value, expire int) error {
+	kind, payload := hostKindNil, []byte(nil)
+	if val != nil {
+		var ok bool
+		if payload, kind, ok = offHeapPayload(val); !ok {
+			return nil
+		}
+		if h.cipher != nil {
+			keyID, sealed, err := h.cipher.Seal(payload, []byte(key))
+			if err != nil {
+				return err
+			}
+			payload = make([]byte, 4, 4+len(sealed))
+			binary.BigEndian.PutUint32(payload, keyID)
+			payload = append(payload, sealed...)
+			kind |= ringFlagSealed
+		}
+	}
+	now := time.Now()
+	var expireAt int64
+	if expire > 0 {
+		expireAt = now.Add(time.Duration(expire) * time.Second).UnixNano()
+	}
+	buf := make([]byte, hostHeaderSize, hostHeaderSize+len(key)+len(payload))
+	copy(buf, hostFileMagic)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint64(buf[12:20], uint64(expireAt))
+	buf[20] = kind
+	binary.BigEndian.PutUint32(buf[21:25], uint32(len(key)))
+	buf = append(append(buf, key...), payload...)
+
+	tmp := fmt.Sprintf("%s.%d.tmp", name, os.Getpid())
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name+".val"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	h.seen.Store(key, hostSeen{writtenAt: now.UnixNano(), expireAt: expireAt})
+	return nil
+}
+
+// sweep 删除已经过期的结果文件以及seen 中过期的记录，由cache 的后台goroutine 调用。结果文件
+// 只在拿到对应的文件锁之后删除，避免删掉其他进程刚写入的结果。锁文件是空文件并且会被重复使用，
+// 删除正在被其他进程打开的锁文件会让两个进程同时拿到锁，所以一直保留
+func (h *hostFlight) sweep() {
+	now := time.Now().UnixNano()
+	h.seen.Range(func(key, v interface{}) bool {
+		if exp := v.(hostSeen).expireAt; exp > 0 && exp < now {
+			h.seen.Delete(key)
+		}
+		return true
+	})
+	files, err := filepath.Glob(filepath.Join(h.dir, "*.val"))
+	if err != nil {
+		return
+	}
+	// 已经结束的ctx 让lockFile 只尝试一次，文件锁被占用的时候跳过
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, path := range files {
+		if !hostExpired(path, now) {
+			continue
+		}
+		unlock, err := lockFile(ctx, strings.TrimSuffix(path, ".val")+".lock", h.poll)
+		if err != nil {
+			continue
+		}
+		if hostExpired(path, now) {
+			os.Remove(path)
+		}
+		unlock()
+	}
+}
+
+// hostExpired 判断结果文件是否已经过期，永不过期以及无法读取的结果文件返回false
+func hostExpired(path string, now int64) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 20)
+	if _, err = io.ReadFull(f, header); err != nil || !bytes.Equal(header[:4], hostFileMagic) {
+		return false
+	}
+	expireAt := int64(binary.BigEndian.Uint64(header[12:20]))
+	return expireAt > 0 && expireAt < now
+}
@@ -0,0 +1,270 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const hostFlightEnv = "SCACHE_HOST_FLIGHT_DIR"
+
+// TestHostFlightHelper 不是真正的测试，由TestHostSingleFlight 作为子进程启动
+func TestHostFlightHelper(t *testing.T) {
+	dir := os.Getenv(hostFlightEnv)
+	if dir == "" {
+		return
+	}
+	ca := New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{Dir: dir}))
+	ca.Register("cold", 10, func() (Value, error) {
+		f, err := os.OpenFile(filepath.Join(dir, "loads"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(f, os.Getpid())
+		f.Close()
+		if os.Getenv("SCACHE_HOST_FLIGHT_CRASH") != "" {
+			// 持有文件锁的进程在加载的过程中退出
+			os.Exit(3)
+		}
+		time.Sleep(300 * time.Millisecond)
+		return StringValue(fmt.Sprint(os.Getpid())), nil
+	})
+	v, err := ca.Get("cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("value=%s handoffs=%d\n", v.(*DefaultStringValue).Value(), ca.Stats().HostHandoffs)
+}
+
+func startHostFlightHelper(dir string, crash bool) (*exec.Cmd, *bytes.Buffer, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHostFlightHelper$")
+	cmd.Env = append(os.Environ(), hostFlightEnv+"="+dir)
+	if crash {
+		cmd.Env = append(cmd.Env, "SCACHE_HOST_FLIGHT_CRASH=1")
+	}
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	return cmd, out, cmd.Start()
+}
+
+// hostFlightResult 子进程的输出中还包含后台goroutine 的日志以及测试框架的输出
+func hostFlightResult(out *bytes.Buffer) string {
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); strings.HasPrefix(line, "value=") {
+			return line
+		}
+	}
+	return ""
+}
+
+func readHostFlightLoads(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+func TestHostSingleFlight(t *testing.T) {
+	Convey("test single flight between processes on the same host ", t, func() {
+		Convey("only one process loads a cold key ", func() {
+			dir := t.TempDir()
+			var outs []*bytes.Buffer
+			var cmds []*exec.Cmd
+			for i := 0; i < 4; i++ {
+				cmd, out, err := startHostFlightHelper(dir, false)
+				So(err, ShouldBeNil)
+				cmds, outs = append(cmds, cmd), append(outs, out)
+			}
+			for _, cmd := range cmds {
+				So(cmd.Wait(), ShouldBeNil)
+			}
+			loads := readHostFlightLoads(filepath.Join(dir, "loads"))
+			So(len(loads), ShouldEqual, 1)
+			handoffs := 0
+			for _, out := range outs {
+				var value string
+				var n int
+				_, err := fmt.Sscanf(hostFlightResult(out), "value=%s handoffs=%d", &value, &n)
+				So(err, ShouldBeNil)
+				So(value, ShouldEqual, loads[0])
+				handoffs += n
+			}
+			So(handoffs, ShouldEqual, 3)
+		})
+
+		Convey("lock is released when the loading process exits ", func() {
+			dir := t.TempDir()
+			crashed, _, err := startHostFlightHelper(dir, true)
+			So(err, ShouldBeNil)
+			So(crashed.Wait(), ShouldNotBeNil)
+			cmd, out, err := startHostFlightHelper(dir, false)
+			So(err, ShouldBeNil)
+			So(cmd.Wait(), ShouldBeNil)
+			loads := readHostFlightLoads(filepath.Join(dir, "loads"))
+			So(len(loads), ShouldEqual, 2)
+			So(hostFlightResult(out), ShouldEqual, fmt.Sprintf("value=%s handoffs=0", loads[1]))
+		})
+
+		Convey("result keeps the remaining ttl and newer local loads are not shadowed ", func() {
+			dir := t.TempDir()
+			var in atomic.Int32
+			loader := func() (Value, error) {
+				return StringValue(fmt.Sprintf("v%d", in.Inc())), nil
+			}
+			a := New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{Dir: dir}))
+			b := New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{Dir: dir}))
+			a.Register("warm", 3, loader)
+			b.Register("warm", 3, loader)
+
+			v, _ := a.Get("warm")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v1")
+			time.Sleep(1100 * time.Millisecond)
+			v, _ = b.Get("warm")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v1")
+			So(b.Stats().HostHandoffs, ShouldEqual, 1)
+
+			// b 拿到的是剩余的有效期，不会比a 晚一个完整的有效期才过期
+			time.Sleep(3 * time.Second)
+			v, _ = b.Get("warm")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v2")
+
+			// a 不会拿回自己写入过的旧结果，但会使用b 写入的更新的结果
+			a.Del("warm")
+			v, _ = a.Get("warm")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v2")
+			a.Del("warm")
+			v, _ = a.Get("warm")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v3")
+			So(in.Load(), ShouldEqual, 3)
+		})
+
+		Convey("files are only accessible by the owner ", func() {
+			dir := t.TempDir()
+			ca := New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{Dir: dir}))
+			ca.Register("private", 10, func() (Value, error) {
+				return StringValue("secret"), nil
+			})
+			ca.Get("private")
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			So(len(files), ShouldEqual, 2)
+			for _, file := range files {
+				info, err := os.Stat(file)
+				So(err, ShouldBeNil)
+				So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+			}
+		})
+
+		Convey("result files are sealed with the cache cipher ", func() {
+			dir := t.TempDir()
+			cipher, _ := NewAESGCMCipher(1, make([]byte, 32))
+			var in atomic.Int32
+			loader := func() (Value, error) {
+				in.Inc()
+				return StringValue("secret"), nil
+			}
+			a := New(1<<20, time.Hour, nil, WithCipher(cipher), WithHostSingleFlight(HostFlightConfig{Dir: dir}))
+			b := New(1<<20, time.Hour, nil, WithCipher(cipher), WithHostSingleFlight(HostFlightConfig{Dir: dir}))
+			plain := New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{Dir: dir}))
+			a.Register("private", 10, loader)
+			b.Register("private", 10, loader)
+			plain.Register("private", 10, loader)
+
+			v, _ := a.Get("private")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "secret")
+			files, _ := filepath.Glob(filepath.Join(dir, "*.val"))
+			So(len(files), ShouldEqual, 1)
+			data, _ := os.ReadFile(files[0])
+			So(bytes.Contains(data, []byte("secret")), ShouldBeFalse)
+
+			v, _ = b.Get("private")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "secret")
+			So(b.Stats().HostHandoffs, ShouldEqual, 1)
+
+			// 没有密钥的进程无法读取，自己加载
+			v, _ = plain.Get("private")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "secret")
+			So(plain.Stats().HostHandoffs, ShouldEqual, 0)
+			So(in.Load(), ShouldEqual, 2)
+		})
+
+		Convey("expired result files and records are swept ", func() {
+			dir := t.TempDir()
+			ca := New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{Dir: dir})).(*cacheImpl)
+			loader := func() (Value, error) {
+				return StringValue("v"), nil
+			}
+			ca.Register("short", 1, loader)
+			ca.Register("forever", 0, loader)
+			ca.Get("short")
+			ca.Get("forever")
+			vals, _ := filepath.Glob(filepath.Join(dir, "*.val"))
+			So(len(vals), ShouldEqual, 2)
+
+			time.Sleep(1100 * time.Millisecond)
+			ca.hostFlight.sweep()
+			vals, _ = filepath.Glob(filepath.Join(dir, "*.val"))
+			So(vals, ShouldResemble, []string{filepath.Join(dir, fmt.Sprintf("%016x.val", hashKey("forever")))})
+			_, ok := ca.hostFlight.seen.Load("short")
+			So(ok, ShouldBeFalse)
+			_, ok = ca.hostFlight.seen.Load("forever")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("dir is validated and failures are reported ", func() {
+			So(func() {
+				New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{}))
+			}, ShouldPanicWith, ErrInValidParam)
+
+			dir := filepath.Join(t.TempDir(), "nested", "flight")
+			ca := New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{Dir: dir})).(*cacheImpl)
+			So(ca.hostFlight, ShouldNotBeNil)
+			info, err := os.Stat(dir)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0700))
+
+			file := filepath.Join(t.TempDir(), "file")
+			So(os.WriteFile(file, nil, 0600), ShouldBeNil)
+			disabled := New(1<<20, time.Hour, nil, WithHostSingleFlight(HostFlightConfig{Dir: filepath.Join(file, "flight")})).(*cacheImpl)
+			So(disabled.hostFlight, ShouldBeNil)
+
+			// 目录被删除之后锁文件无法创建，交给OnError 处理并在进程内加载
+			var reported atomic.Int32
+			ca.SetErrorHandler(func(...interface{}) {
+				reported.Inc()
+			})
+			ca.Register("gone", 10, func() (Value, error) {
+				return StringValue("v"), nil
+			})
+			So(os.RemoveAll(dir), ShouldBeNil)
+			v, err := ca.Get("gone")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v")
+			So(reported.Load(), ShouldEqual, 1)
+		})
+	})
+}
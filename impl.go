@@ -2,9 +2,9 @@ package Scache
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
-	"math"
 	"sync"
 	"time"
 )
@@ -17,6 +17,7 @@ var (
 	ErrBadConvertParamToCall    = errors.New("sCache : Can't Convert Param item[0] to Call")
 
 	ErrRegulationAlreadyExist = errors.New("sCache : regulation already exist ")
+	ErrRegulationNotExist     = errors.New("sCache : regulation is not exist ")
 
 	ErrKeyAlreadyExist = errors.New("sCache : key already exist ")
 	ErrKeyNotExist     = errors.New("sCache : key is not  exist ")
@@ -26,10 +27,75 @@ type cacheImpl struct {
 	rw       sync.RWMutex
 	maxBytes int64
 	nBytes   int64
+
+	// 最大的entry 数量，为0的时候不限制，和maxBytes 任意一个超出都会触发淘汰
+	maxEntries int64
+
 	ll       *list.List
 	interval time.Duration
 	cache    map[string]*list.Element
 
+	// 每个entry 占用内存的统计方式
+	accounting AccountingMode
+
+	// 运行时的统计数据
+	stats stats
+
+	// 当前是否正在分批缩容
+	shrinking bool
+
+	// 根据进程内存压力调整maxBytes 的调节器，没有配置的时候为nil
+	governor *memoryGovernor
+
+	// 写入新key 时的准入策略，没有配置的时候为nil
+	admission Admission
+
+	// 字节存储模式，没有开启的时候为nil
+	offHeap *offHeapStore
+
+	// 超过compressThreshold 的字节类型的值会被压缩存储，compressor 为nil 的时候不压缩
+	compressor        Compressor
+	compressThreshold int
+
+	// 字节类型的值在存储之前会被加密，为nil 的时候不加密
+	cipher Cipher
+
+	// SetObject、GetObject 使用的编解码方式，默认为JSONCodec
+	codec Codec
+
+	// 标签索引 tag -> keys，entry 被真正删除的时候从索引中移除
+	tags map[string]map[string]struct{}
+
+	// 正在后台刷新的regulation，防止同一个key 同时启动多个刷新的goroutine
+	refreshing sync.Map
+
+	// 负缓存，缓存regulation 失败或者数据不存在的结果
+	negatives map[string]negativeEntry
+
+	// 负缓存占用的内存，和nBytes 一起计入maxBytes
+	negativeBytes int64
+
+	// 正在运行的定时任务
+	crons map[string]*cronJob
+
+	// 慢函数的并发限制，和regularManger 共享
+	bulkheads *bulkheads
+
+	// 带租约的锁
+	locks *lockManager
+
+	// 同一台机器上多个进程之间的singleFlight，和regularManger 共享，没有开启的时候为nil
+	hostFlight *hostFlight
+
+	// Close 的时候关闭，后台清理以及governor 的goroutine 随之退出
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// 命名空间，nsList 按照创建顺序保存，保证淘汰时的选择是确定的
+	namespaces map[string]*namespace
+	nsList     []*namespace
+	fairShare  FairSharePolicy
+
 	// 当某个key被删除的时候的回调函数
 	OnCaller func(key string, v Value)
 
@@ -42,10 +108,12 @@ type cacheImpl struct {
 	OnError func(...interface{})
 
 	// singleFlight 管理器，
-	regularManger RegularManger
+	regularManger *defaultRegularManger
 }
 
-func New(maxByte int64, clearInterval time.Duration, clearCall func(key string, value Value)) Cache {
+func New(maxByte int64, clearInterval time.Duration, clearCall func(key string, value Value), opts ...Option) Cache {
+	bh := &bulkheads{groups: map[string]*semaphore{}}
+	rm := newRegularManager(bh)
 	c := &cacheImpl{
 		maxBytes: maxByte,
 		nBytes:   0,
@@ -56,7 +124,29 @@ func New(maxByte int64, clearInterval time.Duration, clearCall func(key string,
 			fmt.Println(i)
 		},
 		OnCaller:      clearCall,
-		regularManger: NewRegularManager(),
+		regularManger: rm,
+		codec:         JSONCodec,
+		negatives:     make(map[string]negativeEntry),
+		crons:         make(map[string]*cronJob),
+		bulkheads:     bh,
+		locks:         newLockManager(),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.hostFlight != nil {
+		c.hostFlight.cipher = c.cipher
+	}
+	rm.host = c.hostFlight
+	if c.governor != nil {
+		c.governor.run(c.done)
+	}
+	if c.offHeap != nil {
+		c.offHeap.grace = c.staleFor
+		if c.admission != nil {
+			c.offHeap.admit = c.admission.Admit
+		}
 	}
 	c.clear()
 	return c
@@ -70,6 +160,13 @@ func (c *cacheImpl) Get(key string) (Value, error) {
 	return c.get(key)
 }
 
+func (c *cacheImpl) GetContext(ctx context.Context, key string) (Value, error) {
+	if ctx == nil {
+		return nil, ErrInValidParam
+	}
+	return c.getContext(ctx, key)
+}
+
 func (c *cacheImpl) Set(key string, value Value) error {
 	if value == nil || key == "" {
 		return ErrInValidParam
@@ -109,72 +206,159 @@ func (c *cacheImpl) SetWithTTL(key string, value Value, ttl int) error {
 	return c.set(key, value, ttl)
 }
 
-func (c *cacheImpl) Register(regulation string, expire int, f /* slow way func */ func() (Value, error)) {
+func (c *cacheImpl) Register(regulation string, expire int, f /* slow way func */ func() (Value, error), opts ...RegulationOption) {
 	if regulation == "" || f == nil || expire < 0 {
 		panic(ErrInValidParam)
 	}
-	c.regularManger.Register(regulation, expire, f)
+	c.regularManger.Register(regulation, expire, f, opts...)
 }
 
-func (c *cacheImpl) RegisterCron(regulation string, flushInterval int, f /* slow way func */ func() (Value, error)) {
-	if regulation == "" || f == nil || flushInterval < 0 {
+func (c *cacheImpl) RegisterContext(regulation string, expire int, f /* slow way func */ func(ctx context.Context) (Value, error), opts ...RegulationOption) {
+	if regulation == "" || f == nil || expire < 0 {
 		panic(ErrInValidParam)
 	}
-	err := c.ticker(regulation, flushInterval, f)
-	if err != nil {
-		panic(err)
-	}
+	c.regularManger.RegisterContext(regulation, expire, f, opts...)
 }
 
-// =============================================concurrency safe =========================================
+func (c *cacheImpl) Unregister(regulation string) bool {
+	return c.regularManger.Unregister(regulation)
+}
+
+func (c *cacheImpl) Replace(regulation string, expire int, f /* slow way func */ func() (Value, error), invalidate bool, opts ...RegulationOption) error {
+	if f == nil {
+		return ErrInValidParam
+	}
+	return c.ReplaceContext(regulation, expire, func(ctx context.Context) (Value, error) {
+		return f()
+	}, invalidate, opts...)
+}
 
-func (c *cacheImpl) ticker(regulation string, flushInterval int, f /* slow way func */ func() (Value, error)) error {
-	if flushInterval <= 0 || regulation == "" {
+func (c *cacheImpl) ReplaceContext(regulation string, expire int, f /* slow way func */ func(ctx context.Context) (Value, error), invalidate bool, opts ...RegulationOption) error {
+	if regulation == "" || f == nil || expire < 0 {
 		return ErrInValidParam
 	}
-	val, _, _, err := c.regularManger.Get(regulation)
+	err := c.regularManger.Replace(regulation, expire, f, opts...)
 	if err != nil {
 		return err
 	}
-	if val != nil {
-		return ErrKeyAlreadyExist
+	if invalidate {
+		c.del(regulation, false)
 	}
-	t := time.NewTicker(time.Duration(flushInterval) * time.Second)
-	go func() {
-		defer func() {
-			// issue error #9
-			if err := recover(); err != nil {
-				c.OnError(fmt.Sprintf("regulation is %s", regulation), err)
-			}
-		}()
-		for {
-			v, er := f()
-			if er != nil {
-				if c.OnError != nil {
-					c.OnError(er)
-				}
-			} else {
-				c.set(regulation, v, 0)
-			}
+	return nil
+}
 
-			<-t.C
-		}
-	}()
+func (c *cacheImpl) ReplacePattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), invalidate bool, opts ...RegulationOption) error {
+	if expr == "" || load == nil || expire < 0 {
+		return ErrInValidParam
+	}
+	p, err := compilePattern(expr)
+	if err != nil {
+		return err
+	}
+	if err = c.regularManger.ReplacePattern(expr, expire, load, opts...); err != nil {
+		return err
+	}
+	if invalidate {
+		c.delMatch(p)
+	}
 	return nil
 }
 
+func (c *cacheImpl) Regulations() []RegulationInfo {
+	return c.regularManger.Regulations()
+}
+
+func (c *cacheImpl) RegisterPattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), opts ...RegulationOption) {
+	if expr == "" || load == nil || expire < 0 {
+		panic(ErrInValidParam)
+	}
+	c.regularManger.RegisterPattern(expr, expire, load, opts...)
+}
+
+func (c *cacheImpl) RegisterCron(regulation string, flushInterval int, f /* slow way func */ func() (Value, error), opts ...CronOption) CronJob {
+	if regulation == "" || f == nil || flushInterval <= 0 {
+		panic(ErrInValidParam)
+	}
+	job, err := c.cron(regulation, everySchedule(time.Duration(flushInterval)*time.Second), true, f, opts)
+	if err != nil {
+		panic(err)
+	}
+	return job
+}
+
+func (c *cacheImpl) RegisterCronSpec(regulation string, spec string, f /* slow way func */ func() (Value, error), opts ...CronOption) CronJob {
+	if regulation == "" || f == nil {
+		panic(ErrInValidParam)
+	}
+	sched, err := parseCronSpec(spec)
+	if err != nil {
+		panic(err)
+	}
+	job, err := c.cron(regulation, sched, false, f, opts)
+	if err != nil {
+		panic(err)
+	}
+	return job
+}
+
+// =============================================concurrency safe =========================================
+
+// cron 启动一个定时任务，同名的regulation 或者定时任务已经存在的时候返回ErrKeyAlreadyExist
+func (c *cacheImpl) cron(regulation string, sched schedule, immediate bool, f /* slow way func */ func() (Value, error), opts []CronOption) (*cronJob, error) {
+	if _, ok := c.regularManger.Info(regulation); ok {
+		return nil, ErrKeyAlreadyExist
+	}
+	job := newCronJob(c, regulation, sched, f, opts)
+	c.rw.Lock()
+	if _, ok := c.crons[regulation]; ok {
+		c.rw.Unlock()
+		return nil, ErrKeyAlreadyExist
+	}
+	c.crons[regulation] = job
+	c.rw.Unlock()
+	go job.loop(immediate)
+	return job, nil
+}
+
+// removeCron 定时任务停止之后从cache 中移除
+func (c *cacheImpl) removeCron(job *cronJob) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	if c.crons[job.regulation] == job {
+		delete(c.crons, job.regulation)
+	}
+}
+
 func (c *cacheImpl) get(key string) (Value, error) {
+	return c.getContext(context.Background(), key)
+}
+
+func (c *cacheImpl) getContext(ctx context.Context, key string) (Value, error) {
 	// 去获取值是否存在于map中且状态不为过期状态
-	if val, ok := c.getDetection(key); ok {
-		return val, nil
+	if val, ok, err := c.detect(key); ok {
+		return val, err
+	}
+	return c.load(ctx, key)
+}
+
+// load 处理未命中的key，先查询负缓存，再通过regulation 加载并存储
+func (c *cacheImpl) load(ctx context.Context, key string) (Value, error) {
+	// 慢函数失败或者数据不存在的结果在负缓存的有效期内直接返回
+	if err, ok := c.negativeGet(key); ok {
+		return nil, err
 	}
 	// 如果key 不存在cache中， 去查询regulation查看是否存在key
-	val, shouldSave, expire, err := c.regularManger.Get(key)
-	if err != nil {
+	val, shouldSave, expire, err := c.regularManger.GetContext(ctx, key)
+	if err != nil && ctx.Err() != nil {
+		// 调用者自己放弃了等待，不是慢函数的失败
 		return nil, err
 	}
+	if err != nil || (val == nil && shouldSave) {
+		return nil, c.negativeSet(key, err)
+	}
 	if shouldSave {
-		if err = c.set(key, val, expire); err != nil {
+		// 被准入策略拒绝只是不存储，本次加载的值依然可以返回给调用者
+		if err = c.set(key, val, expire); err != nil && err != ErrAdmissionRejected {
 			return nil, err
 		}
 	}
@@ -185,9 +369,41 @@ func (c *cacheImpl) get(key string) (Value, error) {
 // 1. 当值为0 的时候表示用不过期
 // 2. 当值为大于0的时候表示，过期时间表示： time_now + expire
 func (c *cacheImpl) set(key string, value Value, expire int) error {
+	return c.setTagged(key, value, expire, nil, true)
+}
+
+// setTagged 同set，同时为key 设置标签，覆盖写入的时候标签也会被覆盖，keepTags 为true 的时候忽略
+// tags，保留key 原来的标签。带有标签的值总是存放在链表中，不会进入字节存储模式
+func (c *cacheImpl) setTagged(key string, value Value, expire int, tags []string, keepTags bool) error {
+	// 压缩和加密不需要持有锁
+	value, err := c.pack(key, value)
+	if err != nil {
+		return err
+	}
 	c.rw.Lock()
 	defer c.rw.Unlock()
-	if int64(value.Len()) > c.maxBytes {
+	c.negativeDel(key)
+	if keepTags {
+		tags = nil
+		if ele, ok := c.getElem(key); ok && ele.Value.(*sds).Status() == SDSStatusNormal {
+			tags = ele.Value.(*sds).tags
+		}
+	}
+	ns := c.nsOf(key)
+	if c.offHeap != nil {
+		if data, kind, ok := offHeapPayload(value); ok && len(tags) == 0 && ns == nil {
+			if err := c.setOffHeap(key, data, kind, expire); err != errRingCollision && err != ErrValueIsBiggerThanMaxByte {
+				return err
+			}
+		}
+		// 同一个key 只会存在于一种存储中，hash 冲突以及超过segment 容量的key 存放在链表中
+		c.offHeap.del(key)
+	}
+	size := c.sizeOf(key, value)
+	if int64(size) > c.maxBytes {
+		return ErrValueIsBiggerThanMaxByte
+	}
+	if ns != nil && c.fairShare == FairShareStrict && ns.maxBytes != 0 && int64(size) > ns.maxBytes {
 		return ErrValueIsBiggerThanMaxByte
 	}
 	if ele, ok := c.getElem(key); ok {
@@ -195,7 +411,6 @@ func (c *cacheImpl) set(key string, value Value, expire int) error {
 		// 1. 这个值存在 ，但是已经过期
 		// 2. 这个值正常
 		kv := ele.Value.(*sds)
-		oldLen := kv.Value.Len()
 		kv.ReUse()
 		if expire > 0 {
 			kv.expire = int64(expire) + time.Now().Unix()
@@ -204,33 +419,52 @@ func (c *cacheImpl) set(key string, value Value, expire int) error {
 		}
 		kv.Value = value
 
-		//当oldLen小于value.Len()的时候，相减变成负数，此时c.nBytes就有可能等于负数
-		newLen := int64(oldLen - value.Len())
-		if newLen < 0 {
-			c.nBytes += int64(math.Abs(float64(newLen)))
-		} else {
-			c.nBytes -= newLen
-			if c.nBytes < 0 {
-				c.nBytes = 0
-			}
+		// 减去写入时记录的大小而不是重新计算旧值，避免Value 在外部被修改之后统计出现漂移
+		c.nBytes += int64(size - kv.size)
+		if kv.ns != nil {
+			kv.ns.nBytes += int64(size - kv.size)
 		}
-		//c.nBytes += int64(oldLen - value.Len())
+		kv.size = size
+		ns = kv.ns
+		c.untag(kv)
+		kv.tags = tags
+		c.tag(kv)
 	} else {
+		if !c.admit(key, size) {
+			c.stats.rejections.Inc()
+			return ErrAdmissionRejected
+		}
 		// 创建新的sds结构体
 		newSds := NewSDS(key, value, expire)
-		eles := c.ll.PushFront(newSds)
+		newSds.size = size
+		newSds.tags = tags
+		newSds.ns = ns
+		c.tag(newSds)
+		eles := c.listOf(newSds).PushFront(newSds)
 		c.cache[key] = eles
-		c.nBytes += int64(newSds.Calculation())
+		c.nBytes += int64(size)
+		if ns != nil {
+			ns.nBytes += int64(size)
+		}
 	}
-	var freeBytes, freeElems int64
-	for c.maxBytes != 0 && c.maxBytes < c.nBytes {
-		freeBytes += c.removeOldest()
-		freeElems++
+	if ns != nil && c.fairShare == FairShareStrict {
+		c.evictNamespace(ns)
 	}
-	if freeBytes != 0 {
+	c.evict()
+	return nil
+}
+
+// evict 淘汰最久未使用的entry，直到maxBytes 和maxEntries 都满足要求，如果当前正在缩容，
+// 每次写入最多只淘汰一个批次，剩下的交给shrink 分批完成，避免单次写入持有锁太久
+func (c *cacheImpl) evict() {
+	var limit int64
+	if c.shrinking {
+		limit = resizeBatch
+	}
+	freeBytes, freeElems := c.evictN(limit)
+	if freeBytes != 0 || freeElems != 0 {
 		fmt.Printf(" sCache : Garbage.Collection.removeOldest， free bytes  %v ,free Element %v \n\r", freeBytes, freeElems)
 	}
-	return nil
 }
 
 func (c *cacheImpl) del(key string, del bool) {
@@ -240,6 +474,12 @@ func (c *cacheImpl) del(key string, del bool) {
 		c.RealDel()
 		return
 	}
+	c.negativeDel(key)
+	if c.offHeap != nil {
+		if v, ok := c.offHeap.del(key); ok {
+			c.onDelete(key, v)
+		}
+	}
 	if v, ok := c.getElem(key); ok {
 		s := v.Value.(*sds)
 		c.fakeDel(s)
@@ -247,21 +487,67 @@ func (c *cacheImpl) del(key string, del bool) {
 	return
 }
 
+// delMatch 删除所有匹配pattern 的key 以及负缓存
+func (c *cacheImpl) delMatch(p *pattern) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	for key := range c.negatives {
+		if _, ok := p.match(key); ok {
+			c.negativeDel(key)
+		}
+	}
+	if c.offHeap != nil {
+		for _, e := range c.offHeap.live() {
+			if _, ok := p.match(e.key); !ok {
+				continue
+			}
+			if v, ok := c.offHeap.del(e.key); ok {
+				c.onDelete(e.key, v)
+			}
+		}
+	}
+	for key, ele := range c.cache {
+		sd := ele.Value.(*sds)
+		if _, ok := p.match(key); ok && sd.Status() != SDSStatusDelete {
+			c.fakeDel(sd)
+		}
+	}
+}
+
 func (c *cacheImpl) expire(key string, ttl int) {
 	c.rw.Lock()
 	defer c.rw.Unlock()
+	if c.offHeap != nil && c.offHeap.expire(key, ttl) {
+		return
+	}
 	if v, ok := c.getElem(key); ok {
 		v.Value.(*sds).expire = time.Now().Unix() + int64(ttl)
 	}
 }
 
+// Close 停止后台清理以及governor 的goroutine，可以重复调用。已经注册的CronJob 需要通过
+// CronJob.Stop 单独停止
+func (c *cacheImpl) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
 func (c *cacheImpl) clear() {
 	go func() {
 		fmt.Printf("sCache : start the backend goroutine , intarvel is %v\n\r", c.interval)
 		for {
-			time.Sleep(c.interval)
+			select {
+			case <-c.done:
+				return
+			case <-time.After(c.interval):
+			}
 			sin := time.Now()
 			counter, free := c.RealDel()
+			c.locks.sweep()
+			if c.hostFlight != nil {
+				c.hostFlight.sweep()
+			}
 			escape := time.Since(sin)
 			if counter > 0 {
 				fmt.Printf("sCache : clear once spend %v , clear %v element ,clear memory %v byte   \n\r", escape, counter, free)
@@ -271,6 +557,23 @@ func (c *cacheImpl) clear() {
 }
 
 func (c *cacheImpl) getDetection(key string) (Value, bool) {
+	if c.admission != nil {
+		c.admission.Record(key)
+	}
+	if c.offHeap != nil {
+		if val, exp, ok, expired := c.offHeap.get(key); ok {
+			if expired {
+				c.stats.staleServes.Inc()
+				c.revalidate(key)
+			} else if exp != 0 && c.refreshAhead(c.regulationOf(key, nil), exp) && c.revalidate(key) {
+				c.stats.refreshAheads.Inc()
+			}
+			return val, true
+		} else if expired {
+			c.onDelete(key, val)
+			return nil, false
+		}
+	}
 	c.rw.RLock()
 	defer c.rw.RUnlock()
 	if ele, ok := c.getElem(key); ok {
@@ -285,7 +588,15 @@ func (c *cacheImpl) getDetection(key string) (Value, bool) {
 			return nil, false
 		}
 		// 2.查看是否过期，如果过期了，将key标注一下更新为过期
-		if s.expire != 0 && s.expire < time.Now().Unix() {
+		if now := time.Now().Unix(); s.expire != 0 && s.expire < now {
+			// 还在regulation 的stale 窗口内，先返回旧值，同时在后台刷新
+			if s.expire+c.staleOf(c.regulationOf(key, s)) >= now {
+				c.stats.staleServes.Inc()
+				c.revalidate(key)
+				c.listOf(s).MoveToFront(ele)
+				return s.Value, true
+			}
+
 			// todo 此时将值进行标准为删除
 			// 第一个准则是存储的所有的内容都先不能删除，进行内存复用
 			// 但是先进行回调删除方法，让用户感知
@@ -295,8 +606,13 @@ func (c *cacheImpl) getDetection(key string) (Value, bool) {
 			return nil, false
 		}
 
+		// 快要过期的regulation 按照概率提前在后台刷新
+		if s.expire != 0 && c.refreshAhead(c.regulationOf(key, s), s.expire) && c.revalidate(key) {
+			c.stats.refreshAheads.Inc()
+		}
+
 		// 当key值存在的时候，需要将值的访问记录进行更新，
-		c.ll.MoveToFront(ele)
+		c.listOf(s).MoveToFront(ele)
 		return s.Value, true
 	}
 	return nil, false
@@ -330,47 +646,101 @@ func (c *cacheImpl) RealDel() (int, int) {
 	fmt.Printf("sCache : RealDel current element counter %v ,current size %v  ,max cap %v \n\r", len(c.cache), c.nBytes, c.maxBytes)
 	counter := 0
 	free := 0
-	for k, v := range c.cache {
+	for _, v := range c.cache {
 		tev := v
 		sd := tev.Value.(*sds)
 		st := sd.Status()
 		if st == SDSStatusDelete {
-			c.ll.Remove(v)
+			c.removeElement(tev)
 			counter++
-			delete(c.cache, k)
-			freeCount := sd.Calculation()
-			c.nBytes -= int64(freeCount)
-			free += freeCount
+			free += sd.size
 			sd.Destroy()
 		}
 
-		if sd.expire != 0 && sd.expire < time.Now().Unix() && st == SDSStatusNormal {
+		if sd.expire != 0 && sd.expire+c.staleOf(c.regulationOf(sd.key, sd)) < time.Now().Unix() && st == SDSStatusNormal {
 			sd.Delete()
 		}
 	}
+	c.negativeSweep(time.Now().Unix())
 	return counter, free
 }
 
 //  =============================================concurrency not safe =========================================
 
+// admit 写入一个新的key 之前判断是否需要淘汰，如果需要淘汰，交给准入策略比较新key 和即将被淘汰
+// 的key 的访问频率，没有配置准入策略的时候总是允许写入
+func (c *cacheImpl) admit(key string, size int) bool {
+	if c.admission == nil {
+		return true
+	}
+	c.admission.Record(key)
+	full := (c.maxBytes != 0 && c.nBytes+int64(size) > c.maxBytes) ||
+		(c.maxEntries != 0 && int64(len(c.cache))+1 > c.maxEntries)
+	victim := c.victim()
+	if !full || victim == nil {
+		return true
+	}
+	return c.admission.Admit(key, victim.Value.(*sds).key)
+}
+
+// evictN 最多淘汰limit 个entry，limit 为0的时候不限制数量，直到满足限制为止。负缓存重新
+// 加载的代价最小，会先于entry 被淘汰
+func (c *cacheImpl) evictN(limit int64) (freeBytes, freeElems int64) {
+	for c.overflow() && len(c.cache)+len(c.negatives) > 0 {
+		if limit > 0 && freeElems >= limit {
+			break
+		}
+		if len(c.negatives) > 0 {
+			freeBytes += c.negativeEvict()
+		} else {
+			freeBytes += c.removeOldest()
+		}
+		freeElems++
+	}
+	return
+}
+
+// overflow 判断当前是否超过了maxBytes 或者maxEntries 的限制，负缓存同样计算在内
+func (c *cacheImpl) overflow() bool {
+	if c.maxBytes != 0 && c.maxBytes < c.nBytes+c.negativeBytes {
+		return true
+	}
+	return c.maxEntries != 0 && c.maxEntries < int64(len(c.cache)+len(c.negatives))
+}
+
 // removeOldest 直接真删除，
 // todo 之前的版本存在一个问题，realDeal后，实际上没有删除掉链表节点
 func (c *cacheImpl) removeOldest() (freeByte int64) {
-	ele := c.ll.Back()
-	if ele != nil {
-		// 删除 链表节点
-		c.ll.Remove(ele)
-		kv := ele.Value.(*sds)
-		delete(c.cache, kv.key)
-		freeByte = int64(kv.Calculation())
-		c.nBytes -= freeByte
-		if c.OnCaller != nil {
-			c.OnCaller(kv.key, kv.Value)
-		}
+	if ele := c.victim(); ele != nil {
+		freeByte = c.evictElement(ele)
 	}
 	return
 }
 
+// evictElement 因为超出限制淘汰一个entry，会回调OnCaller
+func (c *cacheImpl) evictElement(ele *list.Element) int64 {
+	kv := ele.Value.(*sds)
+	c.removeElement(ele)
+	c.stats.evictions.Inc()
+	if kv.ns != nil {
+		kv.ns.evictions.Inc()
+	}
+	c.onDelete(kv.key, kv.Value)
+	return int64(kv.size)
+}
+
+// removeElement 直接删除一个entry 并释放空间，不会回调OnCaller
+func (c *cacheImpl) removeElement(ele *list.Element) {
+	kv := ele.Value.(*sds)
+	c.listOf(kv).Remove(ele)
+	delete(c.cache, kv.key)
+	c.untag(kv)
+	c.nBytes -= int64(kv.size)
+	if kv.ns != nil {
+		kv.ns.nBytes -= int64(kv.size)
+	}
+}
+
 // getElem 并发不安全，需要加锁操作
 func (c *cacheImpl) getElem(key string) (*list.Element, bool) {
 	if ele, ok := c.cache[key]; ok {
@@ -382,7 +752,16 @@ func (c *cacheImpl) getElem(key string) (*list.Element, bool) {
 // fakeDel 假删除，将内容标记为删除
 func (c *cacheImpl) fakeDel(sd *sds) {
 	sd.Delete()
-	if c.OnCaller != nil {
-		c.OnCaller(sd.key, sd.Value)
+	c.onDelete(sd.key, sd.Value)
+}
+
+// onDelete 回调OnCaller，压缩或者加密过的值会先还原再交给用户
+func (c *cacheImpl) onDelete(key string, v Value) {
+	if c.OnCaller == nil {
+		return
+	}
+	if val, err := c.unpack(key, v); err == nil {
+		v = val
 	}
+	c.OnCaller(key, v)
 }
@@ -16,6 +16,7 @@ package Scache
 import (
 	"fmt"
 	"go.uber.org/atomic"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -44,3 +45,34 @@ func BenchmarkCacheImpl_GetKeyWitchRegistered(b *testing.B) {
 		}()
 	}
 }
+
+// benchmarkGCPause 往cache 中写入大量的entry，然后统计每次GC 的平均停顿时间，ns/op 是一次
+// 完整GC 的耗时。cache 的后台goroutine 会一直持有实例，下面两个benchmark 需要分开运行，
+// 否则后运行的那个会把前一个cache 也算进去：
+//
+//	go test -run XXX -bench 'GCPause$'
+//	go test -run XXX -bench 'GCPauseOffHeap'
+func benchmarkGCPause(b *testing.B, ca Cache) {
+	for i := 0; i < 500000; i++ {
+		ca.Set(fmt.Sprintf("key%d", i), ByteValue(make([]byte, 64)))
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "pause-ns/gc")
+	runtime.KeepAlive(ca)
+}
+
+func BenchmarkCacheImpl_GCPause(b *testing.B) {
+	benchmarkGCPause(b, New(1<<30, time.Hour, nil))
+}
+
+func BenchmarkCacheImpl_GCPauseOffHeap(b *testing.B) {
+	benchmarkGCPause(b, New(1<<30, time.Hour, nil, WithOffHeap(OffHeapConfig{Capacity: 1 << 30})))
+}
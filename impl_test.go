@@ -14,6 +14,8 @@
 package Scache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.uber.org/atomic"
@@ -194,4 +196,122 @@ func TestCacheImpl_RegisterCron(t *testing.T) {
 			So(in.Load(),ShouldBeLessThanOrEqualTo,4)
 		})
 	})
-}
\ No newline at end of file
+}
+func TestCacheImpl_Accounting(t *testing.T) {
+	Convey("test memory accounting ", t, func() {
+		Convey("overhead mode should count entry overhead ", func() {
+			ca := New(5000, 10*time.Second, nil, WithAccounting(AccountingOverhead)).(*cacheImpl)
+			ca.Set("key1", StringValue("steven"))
+			So(ca.nBytes, ShouldEqual, 4+6+entryOverhead)
+		})
+		Convey("overwrite should not drift ", func() {
+			ca := New(5000, 10*time.Second, nil).(*cacheImpl)
+			ca.Set("key1", StringValue("steven"))
+			ca.Set("key1", StringValue("st"))
+			ca.Set("key1", StringValue("steven is handsome"))
+			So(ca.nBytes, ShouldEqual, 4+18)
+			So(ca.SelfCheck(), ShouldEqual, 0)
+		})
+		Convey("self check should find drift when value changed outside ", func() {
+			ca := New(5000, 10*time.Second, nil).(*cacheImpl)
+			v := &DefaultByteValue{cot: []byte("steven")}
+			ca.Set("key1", v)
+			v.cot = append(v.cot, "is handsome"...)
+			So(ca.SelfCheck(), ShouldEqual, -11)
+			So(ca.nBytes, ShouldEqual, 4+17)
+		})
+	})
+}
+
+func TestCacheImpl_MaxEntries(t *testing.T) {
+	Convey("test max entries limit ", t, func() {
+		var evicted []string
+		ca := New(5000, 10*time.Second, func(key string, value Value) {
+			evicted = append(evicted, key)
+		}, WithMaxEntries(2))
+		ca.Set("key1", StringValue("v1"))
+		ca.Set("key2", StringValue("v2"))
+		ca.Set("key3", StringValue("v3"))
+		Convey("the oldest key should be evicted ", func() {
+			So(evicted, ShouldResemble, []string{"key1"})
+			st := ca.Stats()
+			So(st.Entries, ShouldEqual, 2)
+			So(st.MaxEntries, ShouldEqual, 2)
+			So(st.Evictions, ShouldEqual, 1)
+		})
+		Convey("shrink max entries at runtime ", func() {
+			ca.SetMaxEntries(1)
+			So(evicted, ShouldResemble, []string{"key1", "key2"})
+			So(ca.Stats().Entries, ShouldEqual, 1)
+			val, err := ca.Get("key3")
+			So(err, ShouldBeNil)
+			So(val.(*DefaultStringValue).Value(), ShouldEqual, "v3")
+		})
+	})
+}
+
+func TestCacheImpl_SetMaxBytes(t *testing.T) {
+	Convey("test resize max bytes at runtime ", t, func() {
+		ca := New(1<<20, 10*time.Second, nil)
+		for i := 0; i < 3*resizeBatch; i++ {
+			ca.Set(fmt.Sprintf("key%05d", i), StringValue("value"))
+		}
+		So(ca.Stats().Entries, ShouldEqual, 3*resizeBatch)
+		Convey("shrink should evict down to the new limit ", func() {
+			ca.SetMaxBytes(100 * 13)
+			st := ca.Stats()
+			So(st.Entries, ShouldEqual, 100)
+			So(st.Bytes, ShouldBeLessThanOrEqualTo, 100*13)
+			So(st.Shrinking, ShouldBeFalse)
+			So(st.ShrinkEvictions, ShouldEqual, 3*resizeBatch-100)
+			val, err := ca.Get(fmt.Sprintf("key%05d", 3*resizeBatch-1))
+			So(err, ShouldBeNil)
+			So(val, ShouldNotBeNil)
+		})
+		Convey("grow should keep the entries ", func() {
+			ca.SetMaxBytes(1 << 21)
+			So(ca.Stats().Entries, ShouldEqual, 3*resizeBatch)
+			So(ca.Stats().MaxBytes, ShouldEqual, 1<<21)
+		})
+	})
+}
+
+func TestCacheImpl_GetContext(t *testing.T) {
+	Convey("test get regulation with context ", t, func() {
+		type traceKey struct{}
+		ca := New(1<<20, time.Hour, nil)
+		ca.RegisterContext("ctx", 10, func(ctx context.Context) (Value, error) {
+			time.Sleep(300 * time.Millisecond)
+			return StringValue(fmt.Sprint(ctx.Value(traceKey{}))), nil
+		}, WithNegativeTTL(10))
+
+		// 第一个调用者超时离开，不会被负缓存，还有调用者在等待，慢函数继续执行并带着第一个调用者ctx 中的值
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), traceKey{}, "span-1"), 50*time.Millisecond)
+		defer cancel()
+		errs := make(chan error, 1)
+		go func() {
+			_, err := ca.GetContext(ctx, "ctx")
+			errs <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		v, err := ca.GetContext(context.Background(), "ctx")
+		So(err, ShouldBeNil)
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "span-1")
+		So(errors.Is(<-errs, context.DeadlineExceeded), ShouldBeTrue)
+
+		v, err = ca.Get("ctx")
+		So(err, ShouldBeNil)
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "span-1")
+
+		// 所有调用者都离开之后慢函数被取消，再次获取的时候重新加载
+		ca.Del("ctx")
+		ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel2()
+		_, err = ca.GetContext(ctx2, "ctx")
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		v, err = ca.Get("ctx")
+		So(err, ShouldBeNil)
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "<nil>")
+		So(ca.Stats().NegativeHits, ShouldEqual, 0)
+	})
+}
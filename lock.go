@@ -0,0 +1,355 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/atomic"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrLockNotHeld 锁已经被释放或者租约已经过期，持有者需要放弃之后的写入
+var ErrLockNotHeld = errors.New("sCache : lock is not held")
+
+// LockMode 锁的模式
+type LockMode int
+
+const (
+	// LockExclusive 写锁，同一时间只有一个持有者
+	LockExclusive LockMode = iota
+
+	// LockShared 读锁，可以有多个持有者，和写锁互斥
+	LockShared
+)
+
+// LockToken 获取锁成功之后返回的凭证，用于释放和续约
+type LockToken struct {
+	Key  string
+	Mode LockMode
+
+	// Fence 单调递增的fencing token，每次获取锁都会得到一个比之前都大的值，下游在写入的时候记录
+	// 见过的最大的Fence，拒绝更小的Fence 的写入，就可以识别出租约已经过期但还在写入的旧持有者
+	Fence uint64
+
+	// Expires 租约过期的时间，过期之后锁会被自动释放
+	Expires time.Time
+}
+
+// Locker 进程内的带租约的锁，key 之间互不影响
+type Locker interface {
+	// Lock 获取key 的写锁，锁被占用的时候等待直到获取成功或者ctx 结束
+	Lock(ctx context.Context, key string, lease time.Duration) (LockToken, error)
+
+	// TryLock 尝试获取key 的写锁，锁被占用的时候立即返回false
+	TryLock(key string, lease time.Duration) (LockToken, bool)
+
+	// RLock 获取key 的读锁，存在写锁或者有Lock 在等待写锁的时候等待直到获取成功或者ctx 结束。
+	// 等待中的写锁优先于新的读锁，持有读锁的调用者不能在写锁等待期间再次获取同一个key 的读锁
+	RLock(ctx context.Context, key string, lease time.Duration) (LockToken, error)
+
+	// TryRLock 尝试获取key 的读锁，存在写锁或者有Lock 在等待写锁的时候立即返回false
+	TryRLock(key string, lease time.Duration) (LockToken, bool)
+
+	// LockMulti 按照固定的顺序获取多个key 的写锁，所有的调用者都按照同样的顺序获取，不会死锁。
+	// 任意一个获取失败的时候释放已经获取的锁并返回错误
+	LockMulti(ctx context.Context, keys []string, lease time.Duration) ([]LockToken, error)
+
+	// Unlock 释放锁，租约已经过期的时候返回ErrLockNotHeld
+	Unlock(token LockToken) error
+
+	// Extend 将租约延长到从现在开始的lease，返回更新之后的token，租约已经过期的时候返回ErrLockNotHeld
+	Extend(token LockToken, lease time.Duration) (LockToken, error)
+}
+
+// lockManager Locker 的实现。锁单独存放在entries 中而不是作为cache 的entry，这样锁不会占用
+// maxBytes，也不会因为内存淘汰被提前释放。租约的过期方式和cache 的entry 一致：访问的时候惰性判断，
+// 同时由cache 的后台清理goroutine 每个interval 调用sweep 删除过期的租约
+type lockManager struct {
+	mu      sync.Mutex
+	entries map[string]*lockEntry
+	fence   atomic.Uint64
+}
+
+// lockEntry 一个key 上的锁，writer 和readers 不会同时存在
+type lockEntry struct {
+	writer  *lockLease
+	readers map[uint64]*lockLease
+
+	// 正在Lock 中等待写锁的调用者数量，不为0的时候新的读锁需要等待，避免写锁饿死
+	writers int
+
+	// 锁的状态发生变化的时候关闭，唤醒所有等待的调用者
+	notify chan struct{}
+}
+
+type lockLease struct {
+	fence   uint64
+	expires time.Time
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{entries: map[string]*lockEntry{}}
+}
+
+func (m *lockManager) Lock(ctx context.Context, key string, lease time.Duration) (LockToken, error) {
+	return m.lock(ctx, key, LockExclusive, lease)
+}
+
+func (m *lockManager) TryLock(key string, lease time.Duration) (LockToken, bool) {
+	tok, ok, _, _ := m.try(key, LockExclusive, lease)
+	return tok, ok
+}
+
+func (m *lockManager) RLock(ctx context.Context, key string, lease time.Duration) (LockToken, error) {
+	return m.lock(ctx, key, LockShared, lease)
+}
+
+func (m *lockManager) TryRLock(key string, lease time.Duration) (LockToken, bool) {
+	tok, ok, _, _ := m.try(key, LockShared, lease)
+	return tok, ok
+}
+
+func (m *lockManager) LockMulti(ctx context.Context, keys []string, lease time.Duration) ([]LockToken, error) {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	tokens := make([]LockToken, 0, len(sorted))
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] {
+			continue
+		}
+		tok, err := m.Lock(ctx, key, lease)
+		if err != nil {
+			for _, acquired := range tokens {
+				m.Unlock(acquired)
+			}
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens, nil
+}
+
+func (m *lockManager) Unlock(token LockToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[token.Key]
+	if !ok {
+		return ErrLockNotHeld
+	}
+	e.prune(time.Now())
+	held := false
+	if e.writer != nil && e.writer.fence == token.Fence {
+		e.writer = nil
+		held = true
+	} else if _, ok := e.readers[token.Fence]; ok {
+		delete(e.readers, token.Fence)
+		held = true
+	}
+	m.changed(token.Key, e)
+	if !held {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+func (m *lockManager) Extend(token LockToken, lease time.Duration) (LockToken, error) {
+	if lease <= 0 {
+		return token, ErrInValidParam
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[token.Key]
+	if !ok {
+		return token, ErrLockNotHeld
+	}
+	now := time.Now()
+	e.prune(now)
+	l := e.readers[token.Fence]
+	if e.writer != nil && e.writer.fence == token.Fence {
+		l = e.writer
+	}
+	if l == nil {
+		m.changed(token.Key, e)
+		return token, ErrLockNotHeld
+	}
+	l.expires = now.Add(lease)
+	token.Expires = l.expires
+	return token, nil
+}
+
+// lock 循环尝试获取锁，失败的时候等待锁的状态变化或者最早的租约过期
+func (m *lockManager) lock(ctx context.Context, key string, mode LockMode, lease time.Duration) (LockToken, error) {
+	if ctx == nil || lease <= 0 {
+		return LockToken{}, ErrInValidParam
+	}
+	if mode == LockExclusive {
+		m.queue(key, 1)
+		defer m.queue(key, -1)
+	}
+	for {
+		tok, ok, changed, until := m.try(key, mode, lease)
+		if ok {
+			return tok, nil
+		}
+		// 只被等待的写锁挡住的时候没有租约可以等待，只等待锁的状态变化
+		var t *time.Timer
+		var expired <-chan time.Time
+		if !until.IsZero() {
+			t = time.NewTimer(time.Until(until))
+			expired = t.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-expired:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return LockToken{}, err
+		}
+	}
+}
+
+// try 尝试获取锁，失败的时候返回锁状态变化的通知以及最早的租约过期时间，没有租约的时候过期时间为零值
+func (m *lockManager) try(key string, mode LockMode, lease time.Duration) (LockToken, bool, <-chan struct{}, time.Time) {
+	if lease <= 0 {
+		return LockToken{}, false, nil, time.Time{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.entry(key)
+	now := time.Now()
+	e.prune(now)
+	if e.writer != nil || (mode == LockExclusive && len(e.readers) != 0) {
+		return LockToken{}, false, e.notify, e.earliest()
+	}
+	if mode == LockShared && e.writers != 0 {
+		// 等待的写锁获取成功或者离开的时候会通知
+		return LockToken{}, false, e.notify, time.Time{}
+	}
+	l := &lockLease{fence: m.fence.Inc(), expires: now.Add(lease)}
+	if mode == LockExclusive {
+		e.writer = l
+	} else {
+		e.readers[l.fence] = l
+	}
+	return LockToken{Key: key, Mode: mode, Fence: l.fence, Expires: l.expires}, true, nil, time.Time{}
+}
+
+// queue 登记或者取消登记一个等待写锁的调用者，取消的时候唤醒被挡住的读锁
+func (m *lockManager) queue(key string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.entry(key)
+	e.writers += delta
+	if delta < 0 {
+		m.changed(key, e)
+	}
+}
+
+// sweep 清理所有过期的租约，由cache 的后台goroutine 调用
+func (m *lockManager) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, e := range m.entries {
+		if e.prune(now) {
+			m.changed(key, e)
+		}
+	}
+}
+
+//  =============================================concurrency not safe =========================================
+
+// entry 返回key 对应的entry，不存在的时候创建
+func (m *lockManager) entry(key string) *lockEntry {
+	e, ok := m.entries[key]
+	if !ok {
+		e = &lockEntry{readers: map[uint64]*lockLease{}, notify: make(chan struct{})}
+		m.entries[key] = e
+	}
+	return e
+}
+
+// changed 唤醒等待的调用者，key 上没有锁也没有等待的写锁的时候删除entry
+func (m *lockManager) changed(key string, e *lockEntry) {
+	close(e.notify)
+	e.notify = make(chan struct{})
+	if e.writer == nil && len(e.readers) == 0 && e.writers == 0 {
+		delete(m.entries, key)
+	}
+}
+
+// prune 删除过期的租约，返回是否有租约过期
+func (e *lockEntry) prune(now time.Time) bool {
+	pruned := false
+	if e.writer != nil && !now.Before(e.writer.expires) {
+		e.writer = nil
+		pruned = true
+	}
+	for fence, l := range e.readers {
+		if !now.Before(l.expires) {
+			delete(e.readers, fence)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// earliest 返回最早过期的租约的过期时间
+func (e *lockEntry) earliest() time.Time {
+	var t time.Time
+	if e.writer != nil {
+		t = e.writer.expires
+	}
+	for _, l := range e.readers {
+		if t.IsZero() || l.expires.Before(t) {
+			t = l.expires
+		}
+	}
+	return t
+}
+
+func (c *cacheImpl) Lock(ctx context.Context, key string, lease time.Duration) (LockToken, error) {
+	return c.locks.Lock(ctx, key, lease)
+}
+
+func (c *cacheImpl) TryLock(key string, lease time.Duration) (LockToken, bool) {
+	return c.locks.TryLock(key, lease)
+}
+
+func (c *cacheImpl) RLock(ctx context.Context, key string, lease time.Duration) (LockToken, error) {
+	return c.locks.RLock(ctx, key, lease)
+}
+
+func (c *cacheImpl) TryRLock(key string, lease time.Duration) (LockToken, bool) {
+	return c.locks.TryRLock(key, lease)
+}
+
+func (c *cacheImpl) LockMulti(ctx context.Context, keys []string, lease time.Duration) ([]LockToken, error) {
+	return c.locks.LockMulti(ctx, keys, lease)
+}
+
+func (c *cacheImpl) Unlock(token LockToken) error {
+	return c.locks.Unlock(token)
+}
+
+func (c *cacheImpl) Extend(token LockToken, lease time.Duration) (LockToken, error) {
+	return c.locks.Extend(token, lease)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_Lock(t *testing.T) {
+	Convey("test lock with lease and fencing token ", t, func() {
+		ca := New(1<<20, time.Hour, nil)
+
+		Convey("exclusive lock and lease expiry ", func() {
+			tok, ok := ca.TryLock("order", 100*time.Millisecond)
+			So(ok, ShouldBeTrue)
+			_, ok = ca.TryLock("order", time.Second)
+			So(ok, ShouldBeFalse)
+			_, ok = ca.TryRLock("order", time.Second)
+			So(ok, ShouldBeFalse)
+
+			// 租约过期之后自动释放，新的持有者拿到更大的fence
+			start := time.Now()
+			next, err := ca.Lock(context.Background(), "order", time.Second)
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 80*time.Millisecond)
+			So(next.Fence, ShouldBeGreaterThan, tok.Fence)
+
+			So(ca.Unlock(tok), ShouldEqual, ErrLockNotHeld)
+			_, err = ca.Extend(tok, time.Second)
+			So(err, ShouldEqual, ErrLockNotHeld)
+			extended, err := ca.Extend(next, time.Hour)
+			So(err, ShouldBeNil)
+			So(extended.Expires.After(next.Expires), ShouldBeTrue)
+			So(ca.Unlock(extended), ShouldBeNil)
+			So(ca.Unlock(extended), ShouldEqual, ErrLockNotHeld)
+		})
+
+		Convey("waiters are woken up by unlock and respect context ", func() {
+			tok, _ := ca.TryLock("order", time.Hour)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := ca.Lock(ctx, "order", time.Second)
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+
+			got := make(chan LockToken, 1)
+			go func() {
+				next, _ := ca.Lock(context.Background(), "order", time.Second)
+				got <- next
+			}()
+			time.Sleep(20 * time.Millisecond)
+			So(ca.Unlock(tok), ShouldBeNil)
+			select {
+			case next := <-got:
+				So(next.Fence, ShouldBeGreaterThan, tok.Fence)
+			case <-time.After(time.Second):
+				So("waiter is not woken up", ShouldBeEmpty)
+			}
+		})
+
+		Convey("readers share the lock and exclude writers ", func() {
+			r1, ok := ca.TryRLock("doc", time.Hour)
+			So(ok, ShouldBeTrue)
+			r2, ok := ca.TryRLock("doc", time.Hour)
+			So(ok, ShouldBeTrue)
+			_, ok = ca.TryLock("doc", time.Hour)
+			So(ok, ShouldBeFalse)
+			So(ca.Unlock(r1), ShouldBeNil)
+			_, ok = ca.TryLock("doc", time.Hour)
+			So(ok, ShouldBeFalse)
+			So(ca.Unlock(r2), ShouldBeNil)
+			w, ok := ca.TryLock("doc", time.Hour)
+			So(ok, ShouldBeTrue)
+			So(w.Mode, ShouldEqual, LockExclusive)
+		})
+
+		Convey("waiting writer blocks new readers ", func() {
+			r1, ok := ca.TryRLock("doc", time.Hour)
+			So(ok, ShouldBeTrue)
+			acquired := make(chan LockToken, 1)
+			go func() {
+				w, _ := ca.Lock(context.Background(), "doc", time.Hour)
+				acquired <- w
+			}()
+			time.Sleep(50 * time.Millisecond)
+			_, ok = ca.TryRLock("doc", time.Hour)
+			So(ok, ShouldBeFalse)
+			// 只被等待的写锁挡住的读锁没有可以等待的租约，只等待锁的状态变化而不是空转
+			_, ok, _, until := ca.(*cacheImpl).locks.try("doc", LockShared, time.Hour)
+			So(ok, ShouldBeFalse)
+			So(until.IsZero(), ShouldBeTrue)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := ca.RLock(ctx, "doc", time.Hour)
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+
+			So(ca.Unlock(r1), ShouldBeNil)
+			w := <-acquired
+			So(w.Mode, ShouldEqual, LockExclusive)
+			So(ca.Unlock(w), ShouldBeNil)
+			r2, ok := ca.TryRLock("doc", time.Hour)
+			So(ok, ShouldBeTrue)
+			So(ca.Unlock(r2), ShouldBeNil)
+			So(len(ca.(*cacheImpl).locks.entries), ShouldEqual, 0)
+		})
+
+		Convey("multi key lock does not deadlock ", func() {
+			var holders, overlap atomic.Int32
+			wg := sync.WaitGroup{}
+			for i := 0; i < 20; i++ {
+				keys := []string{"a", "b", "c"}
+				if i%2 == 1 {
+					keys = []string{"c", "b", "a", "a"}
+				}
+				wg.Add(1)
+				go func(keys []string) {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					tokens, err := ca.LockMulti(ctx, keys, time.Second)
+					if err != nil {
+						overlap.Inc()
+						return
+					}
+					if holders.Inc() > 1 {
+						overlap.Inc()
+					}
+					time.Sleep(time.Millisecond)
+					holders.Dec()
+					for _, tok := range tokens {
+						ca.Unlock(tok)
+					}
+				}(keys)
+			}
+			wg.Wait()
+			So(overlap.Load(), ShouldEqual, 0)
+		})
+
+		Convey("locks in namespace are isolated ", func() {
+			ns := ca.Namespace("tenant", NamespaceQuota{})
+			tok, ok := ns.TryLock("order", time.Hour)
+			So(ok, ShouldBeTrue)
+			So(tok.Key, ShouldEqual, "order")
+			_, ok = ca.TryLock("order", time.Hour)
+			So(ok, ShouldBeTrue)
+			So(ns.Unlock(tok), ShouldBeNil)
+		})
+	})
+}
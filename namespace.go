@@ -0,0 +1,497 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"container/list"
+	"context"
+	"go.uber.org/atomic"
+	"strings"
+	"time"
+)
+
+// namespaceSeparator 命名空间和key 之间的分隔符，命名空间 a 下的key b 实际存储为 a\x00b。
+// 使用正常的key 中不会出现的字符，root 上的 a:b 这样的key 不会被当作命名空间a 中的key
+const namespaceSeparator = "\x00"
+
+// FairSharePolicy 多个命名空间共享全局容量时的策略
+type FairSharePolicy uint8
+
+const (
+	// FairShareStrict 每个命名空间都不能超过自己的配额，超出的时候只淘汰自己的entry
+	FairShareStrict FairSharePolicy = iota
+
+	// FairShareBorrow 全局容量还有空闲的时候，命名空间可以超出自己的配额借用其他命名空间没有
+	// 使用的容量。全局容量满了之后，优先淘汰超出配额最多的命名空间
+	FairShareBorrow
+)
+
+// NamespaceQuota 命名空间的配额，为0的时候表示不限制，只受全局的限制
+type NamespaceQuota struct {
+	MaxBytes   int64
+	MaxEntries int64
+}
+
+// namespace 命名空间拥有自己的LRU 链表和统计，entry 依然存放在cache 的map 中，key 带有前缀
+type namespace struct {
+	c      *cacheImpl
+	name   string
+	prefix string
+
+	// 以下字段由c.rw 保护
+	ll         *list.List
+	nBytes     int64
+	maxBytes   int64
+	maxEntries int64
+
+	evictions atomic.Int64
+}
+
+// Namespace 返回一个命名空间视图，所有的key、regulation 和tag 都会自动加上 name\x00 前缀。
+// 命名空间是平铺的，name 中不能包含 "\x00"，在命名空间视图上调用Namespace 等同于在cache 上调用。
+// 同一个name 重复调用会返回同一个命名空间并更新配额
+func (c *cacheImpl) Namespace(name string, quota NamespaceQuota) Cache {
+	if name == "" || strings.Contains(name, namespaceSeparator) || quota.MaxBytes < 0 || quota.MaxEntries < 0 {
+		panic(ErrInValidParam)
+	}
+	c.rw.Lock()
+	ns, ok := c.namespaces[name]
+	if !ok {
+		ns = &namespace{
+			c:      c,
+			name:   name,
+			prefix: name + namespaceSeparator,
+			ll:     list.New(),
+		}
+		if c.namespaces == nil {
+			c.namespaces = map[string]*namespace{}
+		}
+		c.namespaces[name] = ns
+		c.nsList = append(c.nsList, ns)
+	}
+	ns.maxBytes, ns.maxEntries = quota.MaxBytes, quota.MaxEntries
+	if c.fairShare == FairShareStrict {
+		c.evictNamespace(ns)
+	}
+	c.rw.Unlock()
+	return &namespaceView{ns: ns, c: c}
+}
+
+// Flush 删除cache 中所有的entry，包括所有命名空间以及字节存储模式中的entry，每个entry 都会回调OnCaller
+func (c *cacheImpl) Flush() {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	c.flushList(c.ll)
+	for _, ns := range c.nsList {
+		c.flushList(ns.ll)
+	}
+	if c.offHeap != nil {
+		for _, e := range c.offHeap.reset(c.OnCaller != nil) {
+			c.onDelete(e.key, e.value)
+		}
+	}
+	c.negatives = make(map[string]negativeEntry)
+	c.negativeBytes = 0
+}
+
+//  =============================================concurrency not safe =========================================
+
+// flushList 删除链表中所有的entry
+func (c *cacheImpl) flushList(ll *list.List) {
+	for ele := ll.Back(); ele != nil; ele = ll.Back() {
+		kv := ele.Value.(*sds)
+		c.removeElement(ele)
+		c.onDelete(kv.key, kv.Value)
+	}
+}
+
+// nsOf 根据key 的前缀找到所属的命名空间
+func (c *cacheImpl) nsOf(key string) *namespace {
+	if len(c.namespaces) == 0 {
+		return nil
+	}
+	idx := strings.Index(key, namespaceSeparator)
+	if idx <= 0 {
+		return nil
+	}
+	return c.namespaces[key[:idx]]
+}
+
+// listOf 返回sd 所在的LRU 链表
+func (c *cacheImpl) listOf(sd *sds) *list.List {
+	if sd.ns != nil {
+		return sd.ns.ll
+	}
+	return c.ll
+}
+
+// victim 选择下一个被淘汰的entry。没有命名空间的时候就是主链表的最后一个，有命名空间的时候
+// 选择使用率最高的链表的最后一个，使用率是已用容量和配额的比值，没有配额的链表和全局限制比较，
+// 所以超出配额的命名空间总是最先被淘汰
+func (c *cacheImpl) victim() *list.Element {
+	if len(c.nsList) == 0 {
+		return c.ll.Back()
+	}
+	rootBytes := c.nBytes
+	for _, ns := range c.nsList {
+		rootBytes -= ns.nBytes
+	}
+	best, bestUsage := c.ll, usage(rootBytes, c.ll.Len(), c.maxBytes, c.maxEntries)
+	if c.ll.Len() == 0 {
+		best, bestUsage = nil, -1
+	}
+	for _, ns := range c.nsList {
+		if ns.ll.Len() == 0 {
+			continue
+		}
+		maxBytes, maxEntries := ns.maxBytes, ns.maxEntries
+		if maxBytes == 0 {
+			maxBytes = c.maxBytes
+		}
+		if maxEntries == 0 {
+			maxEntries = c.maxEntries
+		}
+		if u := usage(ns.nBytes, ns.ll.Len(), maxBytes, maxEntries); u > bestUsage {
+			best, bestUsage = ns.ll, u
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.Back()
+}
+
+// evictNamespace 淘汰命名空间中最久未使用的entry，直到满足命名空间的配额
+func (c *cacheImpl) evictNamespace(ns *namespace) {
+	for ns.overQuota() {
+		c.evictElement(ns.ll.Back())
+	}
+}
+
+func (ns *namespace) overQuota() bool {
+	if ns.ll.Len() == 0 {
+		return false
+	}
+	if ns.maxBytes != 0 && ns.nBytes > ns.maxBytes {
+		return true
+	}
+	return ns.maxEntries != 0 && int64(ns.ll.Len()) > ns.maxEntries
+}
+
+func usage(bytes int64, entries int, maxBytes, maxEntries int64) float64 {
+	var u float64
+	if maxBytes > 0 {
+		u = float64(bytes) / float64(maxBytes)
+	}
+	if maxEntries > 0 {
+		if e := float64(entries) / float64(maxEntries); e > u {
+			u = e
+		}
+	}
+	return u
+}
+
+// namespaceView 是命名空间对外的Cache 实现，只负责给key 加上前缀，然后交给cache 处理
+type namespaceView struct {
+	ns *namespace
+	c  *cacheImpl
+}
+
+func (v *namespaceView) key(key string) string {
+	if key == "" {
+		return ""
+	}
+	return v.ns.prefix + key
+}
+
+func (v *namespaceView) Get(key string) (Value, error) {
+	return v.c.Get(v.key(key))
+}
+
+func (v *namespaceView) GetContext(ctx context.Context, key string) (Value, error) {
+	return v.c.GetContext(ctx, v.key(key))
+}
+
+// MGet 返回的key 不包含命名空间的前缀
+func (v *namespaceView) MGet(ctx context.Context, keys ...string) (map[string]Value, error) {
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, v.key(key))
+	}
+	res, err := v.c.MGet(ctx, prefixed...)
+	trimmed := make(map[string]Value, len(res))
+	for key, val := range res {
+		trimmed[strings.TrimPrefix(key, v.ns.prefix)] = val
+	}
+	return trimmed, err
+}
+
+func (v *namespaceView) Set(key string, value Value) error {
+	return v.c.Set(v.key(key), value)
+}
+
+func (v *namespaceView) SetNX(key string, value Value) error {
+	return v.c.SetNX(v.key(key), value)
+}
+
+func (v *namespaceView) SetEX(key string, value Value) error {
+	return v.c.SetEX(v.key(key), value)
+}
+
+func (v *namespaceView) SetErrorHandler(handler func(...interface{})) {
+	v.c.SetErrorHandler(handler)
+}
+
+func (v *namespaceView) SetWithTTL(key string, content Value, ttl int) error {
+	return v.c.SetWithTTL(v.key(key), content, ttl)
+}
+
+func (v *namespaceView) Del(key string) {
+	v.c.Del(v.key(key))
+}
+
+func (v *namespaceView) Expire(key string, ttl int) {
+	v.c.Expire(v.key(key), ttl)
+}
+
+func (v *namespaceView) Register(regulation string, expire int, f /* slow way func */ func() (Value, error), opts ...RegulationOption) {
+	v.c.Register(v.key(regulation), expire, f, opts...)
+}
+
+func (v *namespaceView) RegisterContext(regulation string, expire int, f /* slow way func */ func(ctx context.Context) (Value, error), opts ...RegulationOption) {
+	v.c.RegisterContext(v.key(regulation), expire, f, opts...)
+}
+
+func (v *namespaceView) Unregister(regulation string) bool {
+	return v.c.Unregister(v.key(regulation))
+}
+
+func (v *namespaceView) Replace(regulation string, expire int, f /* slow way func */ func() (Value, error), invalidate bool, opts ...RegulationOption) error {
+	return v.c.Replace(v.key(regulation), expire, f, invalidate, opts...)
+}
+
+func (v *namespaceView) ReplaceContext(regulation string, expire int, f /* slow way func */ func(ctx context.Context) (Value, error), invalidate bool, opts ...RegulationOption) error {
+	return v.c.ReplaceContext(v.key(regulation), expire, f, invalidate, opts...)
+}
+
+// Regulations 只返回这个命名空间的regulation，名称不包含命名空间的前缀
+func (v *namespaceView) Regulations() []RegulationInfo {
+	var res []RegulationInfo
+	for _, info := range v.c.Regulations() {
+		if strings.HasPrefix(info.Name, v.ns.prefix) {
+			info.Name = strings.TrimPrefix(info.Name, v.ns.prefix)
+			res = append(res, info)
+		}
+	}
+	return res
+}
+
+// RegisterBatch load 拿到的key 以及返回的key 都不包含命名空间的前缀
+func (v *namespaceView) RegisterBatch(expr string, expire int, load func(ctx context.Context, keys []string) (map[string]Value, error), opts ...RegulationOption) {
+	if load == nil {
+		panic(ErrInValidParam)
+	}
+	v.c.RegisterBatch(v.key(expr), expire, func(ctx context.Context, keys []string) (map[string]Value, error) {
+		trimmed := make([]string, 0, len(keys))
+		for _, key := range keys {
+			trimmed = append(trimmed, strings.TrimPrefix(key, v.ns.prefix))
+		}
+		res, err := load(ctx, trimmed)
+		prefixed := make(map[string]Value, len(res))
+		for key, val := range res {
+			prefixed[v.key(key)] = val
+		}
+		return prefixed, err
+	}, opts...)
+}
+
+// ReplacePattern load 拿到的key 不包含命名空间的前缀
+func (v *namespaceView) ReplacePattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), invalidate bool, opts ...RegulationOption) error {
+	if load == nil {
+		return ErrInValidParam
+	}
+	return v.c.ReplacePattern(v.key(expr), expire, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+		return load(ctx, strings.TrimPrefix(key, v.ns.prefix), params)
+	}, invalidate, opts...)
+}
+
+// RegisterPattern load 拿到的key 不包含命名空间的前缀
+func (v *namespaceView) RegisterPattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), opts ...RegulationOption) {
+	if load == nil {
+		panic(ErrInValidParam)
+	}
+	v.c.RegisterPattern(v.key(expr), expire, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+		return load(ctx, strings.TrimPrefix(key, v.ns.prefix), params)
+	}, opts...)
+}
+
+func (v *namespaceView) RegisterCron(regulation string, flushInterval int, f /* slow way func */ func() (Value, error), opts ...CronOption) CronJob {
+	return v.c.RegisterCron(v.key(regulation), flushInterval, f, opts...)
+}
+
+func (v *namespaceView) RegisterCronSpec(regulation string, spec string, f /* slow way func */ func() (Value, error), opts ...CronOption) CronJob {
+	return v.c.RegisterCronSpec(v.key(regulation), spec, f, opts...)
+}
+
+func (v *namespaceView) SelfCheck() int64 {
+	return v.c.SelfCheck()
+}
+
+// SetMaxEntries 调整命名空间的entry 配额
+func (v *namespaceView) SetMaxEntries(n int64) {
+	if n < 0 {
+		return
+	}
+	v.c.rw.Lock()
+	defer v.c.rw.Unlock()
+	v.ns.maxEntries = n
+	if v.c.fairShare == FairShareStrict {
+		v.c.evictNamespace(v.ns)
+	}
+}
+
+// SetMaxBytes 调整命名空间的内存配额
+func (v *namespaceView) SetMaxBytes(n int64) {
+	if n <= 0 {
+		return
+	}
+	v.c.rw.Lock()
+	defer v.c.rw.Unlock()
+	v.ns.maxBytes = n
+	if v.c.fairShare == FairShareStrict {
+		v.c.evictNamespace(v.ns)
+	}
+}
+
+// Stats 只返回命名空间自己的统计数据
+func (v *namespaceView) Stats() Stats {
+	v.c.rw.RLock()
+	defer v.c.rw.RUnlock()
+	return Stats{
+		Entries:    int64(v.ns.ll.Len()),
+		MaxEntries: v.ns.maxEntries,
+		Bytes:      v.ns.nBytes,
+		MaxBytes:   v.ns.maxBytes,
+		Evictions:  v.ns.evictions.Load(),
+	}
+}
+
+func (v *namespaceView) SetObject(key string, obj interface{}, ttl int) error {
+	return v.c.SetObject(v.key(key), obj, ttl)
+}
+
+func (v *namespaceView) GetObject(key string, dst interface{}) error {
+	return v.c.GetObject(v.key(key), dst)
+}
+
+func (v *namespaceView) RegisterObject(regulation string, expire int, f /* slow way func */ func() (interface{}, error), opts ...RegulationOption) {
+	v.c.RegisterObject(v.key(regulation), expire, f, opts...)
+}
+
+func (v *namespaceView) SetWithTags(key string, value Value, ttl int, tags ...string) error {
+	prefixed := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t != "" {
+			prefixed = append(prefixed, v.key(t))
+		}
+	}
+	return v.c.SetWithTags(v.key(key), value, ttl, prefixed...)
+}
+
+func (v *namespaceView) InvalidateTag(tag string) int {
+	return v.c.InvalidateTag(v.key(tag))
+}
+
+func (v *namespaceView) TagCount(tag string) int {
+	return v.c.TagCount(v.key(tag))
+}
+
+func (v *namespaceView) Tags() map[string]int {
+	res := map[string]int{}
+	for tag, n := range v.c.Tags() {
+		if strings.HasPrefix(tag, v.ns.prefix) {
+			res[strings.TrimPrefix(tag, v.ns.prefix)] = n
+		}
+	}
+	return res
+}
+
+func (v *namespaceView) Namespace(name string, quota NamespaceQuota) Cache {
+	return v.c.Namespace(name, quota)
+}
+
+// Flush 只删除这个命名空间中的entry
+func (v *namespaceView) Flush() {
+	v.c.rw.Lock()
+	defer v.c.rw.Unlock()
+	v.c.flushList(v.ns.ll)
+	for key := range v.c.negatives {
+		if v.c.nsOf(key) == v.ns {
+			v.c.negativeDel(key)
+		}
+	}
+}
+
+// Close 命名空间的后台goroutine 属于根cache，需要关闭根cache
+func (v *namespaceView) Close() {}
+
+// Lock 命名空间中的锁和其他命名空间互不影响，返回的token 中的key 不包含命名空间的前缀
+func (v *namespaceView) Lock(ctx context.Context, key string, lease time.Duration) (LockToken, error) {
+	tok, err := v.c.Lock(ctx, v.key(key), lease)
+	return v.token(tok), err
+}
+
+func (v *namespaceView) TryLock(key string, lease time.Duration) (LockToken, bool) {
+	tok, ok := v.c.TryLock(v.key(key), lease)
+	return v.token(tok), ok
+}
+
+func (v *namespaceView) RLock(ctx context.Context, key string, lease time.Duration) (LockToken, error) {
+	tok, err := v.c.RLock(ctx, v.key(key), lease)
+	return v.token(tok), err
+}
+
+func (v *namespaceView) TryRLock(key string, lease time.Duration) (LockToken, bool) {
+	tok, ok := v.c.TryRLock(v.key(key), lease)
+	return v.token(tok), ok
+}
+
+func (v *namespaceView) LockMulti(ctx context.Context, keys []string, lease time.Duration) ([]LockToken, error) {
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, v.key(key))
+	}
+	tokens, err := v.c.LockMulti(ctx, prefixed, lease)
+	for i := range tokens {
+		tokens[i] = v.token(tokens[i])
+	}
+	return tokens, err
+}
+
+func (v *namespaceView) Unlock(token LockToken) error {
+	token.Key = v.key(token.Key)
+	return v.c.Unlock(token)
+}
+
+func (v *namespaceView) Extend(token LockToken, lease time.Duration) (LockToken, error) {
+	token.Key = v.key(token.Key)
+	tok, err := v.c.Extend(token, lease)
+	return v.token(tok), err
+}
+
+// token 去掉token 中key 的命名空间前缀
+func (v *namespaceView) token(tok LockToken) LockToken {
+	tok.Key = strings.TrimPrefix(tok.Key, v.ns.prefix)
+	return tok
+}
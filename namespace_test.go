@@ -0,0 +1,120 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_Namespace(t *testing.T) {
+	Convey("test namespace quota and isolation ", t, func() {
+		var evicted []string
+		ca := New(1<<20, 10*time.Second, func(key string, value Value) {
+			evicted = append(evicted, key)
+		})
+		teamA := ca.Namespace("teamA", NamespaceQuota{MaxEntries: 2})
+		teamB := ca.Namespace("teamB", NamespaceQuota{MaxEntries: 10})
+
+		teamB.Set("k1", StringValue("b1"))
+		teamA.Set("k1", StringValue("a1"))
+		teamA.Set("k2", StringValue("a2"))
+		teamA.Set("k3", StringValue("a3"))
+
+		Convey("key should be prefixed ", func() {
+			v, _ := ca.Get("teamB\x00k1")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "b1")
+			v, _ = teamA.Get("k2")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "a2")
+		})
+
+		Convey("root key looks like a namespace key should stay in root ", func() {
+			ca.Set("teamA:k9", StringValue("root"))
+			v, _ := ca.Get("teamB:k1")
+			So(v, ShouldBeNil)
+			v, _ = teamA.Get("k9")
+			So(v, ShouldBeNil)
+			So(teamA.Stats().Entries, ShouldEqual, 2)
+			So(evicted, ShouldResemble, []string{"teamA\x00k1"})
+		})
+
+		Convey("burst should only evict its own entries ", func() {
+			So(evicted, ShouldResemble, []string{"teamA\x00k1"})
+			So(teamA.Stats().Entries, ShouldEqual, 2)
+			So(teamA.Stats().Evictions, ShouldEqual, 1)
+			So(teamB.Stats().Entries, ShouldEqual, 1)
+			So(ca.Stats().Entries, ShouldEqual, 3)
+		})
+
+		Convey("flush should only remove the namespace ", func() {
+			teamA.Flush()
+			So(teamA.Stats().Entries, ShouldEqual, 0)
+			So(teamA.Stats().Bytes, ShouldEqual, 0)
+			v, _ := teamB.Get("k1")
+			So(v, ShouldNotBeNil)
+			So(ca.Stats().Entries, ShouldEqual, 1)
+		})
+
+		Convey("tags should be scoped ", func() {
+			teamA.SetWithTags("k4", StringValue("a4"), 0, "product")
+			teamB.SetWithTags("k4", StringValue("b4"), 0, "product")
+			So(teamA.Tags(), ShouldResemble, map[string]int{"product": 1})
+			So(teamA.InvalidateTag("product"), ShouldEqual, 1)
+			v, _ := teamB.Get("k4")
+			So(v, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCacheImpl_NamespaceFairShare(t *testing.T) {
+	Convey("test borrow unused quota ", t, func() {
+		ca := New(1<<20, 10*time.Second, nil, WithMaxEntries(10), WithFairShare(FairShareBorrow))
+		teamA := ca.Namespace("teamA", NamespaceQuota{MaxEntries: 5})
+		teamB := ca.Namespace("teamB", NamespaceQuota{MaxEntries: 5})
+		for i := 0; i < 8; i++ {
+			teamA.Set(fmt.Sprint(i), StringValue("a"))
+		}
+		So(teamA.Stats().Entries, ShouldEqual, 8)
+
+		Convey("global cap should evict the namespace over its quota first ", func() {
+			for i := 0; i < 4; i++ {
+				teamB.Set(fmt.Sprint(i), StringValue("b"))
+			}
+			So(ca.Stats().Entries, ShouldEqual, 10)
+			So(teamB.Stats().Entries, ShouldEqual, 4)
+			So(teamA.Stats().Entries, ShouldEqual, 6)
+			v, _ := teamA.Get("0")
+			So(v, ShouldBeNil)
+			v, _ = teamA.Get("7")
+			So(v, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCacheImpl_FlushOffHeap(t *testing.T) {
+	Convey("test flush should call OnCaller for off heap entries ", t, func() {
+		var deleted []string
+		ca := New(1<<20, 10*time.Second, func(key string, value Value) {
+			deleted = append(deleted, key+"="+value.(*DefaultStringValue).Value())
+		}, WithOffHeap(OffHeapConfig{Capacity: 1 << 16, Segments: 1}))
+		ca.Set("k1", StringValue("v1"))
+		ca.Set("k2", StringValue("v2"))
+		ca.Set("k1", StringValue("v3"))
+		ca.Flush()
+		So(deleted, ShouldResemble, []string{"k2=v2", "k1=v3"})
+		So(ca.Stats().OffHeapEntries, ShouldEqual, 0)
+	})
+}
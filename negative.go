@@ -0,0 +1,151 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound 慢函数可以返回ErrNotFound（或者返回nil 值）表示数据不存在，开启了负缓存的regulation
+// 会将不存在的结果缓存起来，在NegativeTTL 内Get 直接返回nil
+var ErrNotFound = errors.New("sCache : value not found")
+
+// ErrCachedFailure 慢函数失败之后被负缓存起来的错误，在NegativeTTL 内Get 都会返回这个错误而不会
+// 再次调用慢函数，可以通过errors.Is、errors.As 判断原始的错误
+type ErrCachedFailure struct {
+	Err   error     // 慢函数返回的原始错误
+	Until time.Time // 负缓存失效的时间
+}
+
+func (e *ErrCachedFailure) Error() string {
+	return "sCache : cached failure : " + e.Err.Error()
+}
+
+func (e *ErrCachedFailure) Unwrap() error {
+	return e.Err
+}
+
+// negativeOverhead 每个负缓存除了key 和错误信息之外大约占用的内存
+const negativeOverhead = 48
+
+// negativeEntry 负缓存，err 为nil 的时候表示数据不存在。负缓存和entry 一起计入maxBytes 和
+// maxEntries，超出限制的时候优先淘汰负缓存
+type negativeEntry struct {
+	err    error
+	expire int64
+	size   int64
+}
+
+// negativeGet 查询key 是否被负缓存，命中不存在的结果的时候返回的错误为nil
+func (c *cacheImpl) negativeGet(key string) (error, bool) {
+	now := time.Now().Unix()
+	c.rw.RLock()
+	e, ok := c.negatives[key]
+	c.rw.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if e.expire < now {
+		c.rw.Lock()
+		if e, ok := c.negatives[key]; ok && e.expire < now {
+			c.negativeDel(key)
+		}
+		c.rw.Unlock()
+		return nil, false
+	}
+	c.stats.negativeHits.Inc()
+	return e.err, true
+}
+
+// negativeSet 在regulation 开启了负缓存的时候缓存慢函数失败或者数据不存在的结果，err 为nil 的时候
+// 表示数据不存在。返回值是调用者需要返回的错误
+func (c *cacheImpl) negativeSet(key string, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	// 熔断器已经在保护慢函数，被限流拒绝或者被取消的加载也不是慢函数的失败，都不需要负缓存
+	var shed *LoadShedError
+	if err == ErrCircuitOpen || errors.As(err, &shed) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	info, ok := c.regularManger.Info(key)
+	if !ok || info.Options.NegativeTTL <= 0 {
+		return err
+	}
+	until := time.Now().Add(time.Duration(info.Options.NegativeTTL) * time.Second)
+	if err != nil {
+		err = &ErrCachedFailure{Err: err, Until: until}
+	}
+	size := int64(len(key)) + negativeOverhead
+	if err != nil {
+		size += int64(len(err.Error()))
+	}
+	c.rw.Lock()
+	c.negativeDel(key)
+	c.negatives[key] = negativeEntry{err: err, expire: until.Unix(), size: size}
+	c.negativeBytes += size
+	c.evict()
+	c.rw.Unlock()
+	if failure, ok := err.(*ErrCachedFailure); ok {
+		// 第一次失败依然返回原始的错误
+		return failure.Err
+	}
+	return nil
+}
+
+//  =============================================concurrency not safe =========================================
+
+// negativeDel 写入或者删除key 的时候清除负缓存
+func (c *cacheImpl) negativeDel(key string) {
+	if len(c.negatives) == 0 {
+		return
+	}
+	if e, ok := c.negatives[key]; ok {
+		delete(c.negatives, key)
+		c.negativeBytes -= e.size
+	}
+}
+
+// negativeSweep 删除所有过期的负缓存，返回删除的数量
+func (c *cacheImpl) negativeSweep(now int64) int {
+	counter := 0
+	for key, e := range c.negatives {
+		if e.expire < now {
+			c.negativeDel(key)
+			counter++
+		}
+	}
+	return counter
+}
+
+// negativeEvict 超出限制的时候淘汰一个负缓存，优先淘汰已经过期的，返回释放的内存
+func (c *cacheImpl) negativeEvict() int64 {
+	now := time.Now().Unix()
+	victim, found := "", false
+	for key, e := range c.negatives {
+		victim, found = key, true
+		if e.expire < now {
+			break
+		}
+	}
+	if !found {
+		return 0
+	}
+	size := c.negatives[victim].size
+	c.negativeDel(victim)
+	return size
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_NegativeCache(t *testing.T) {
+	Convey("test cache failures and not found results of regulation ", t, func() {
+		errBackend := errors.New("backend is down")
+		var calls, missing atomic.Int32
+		ca := New(1<<20, time.Hour, nil)
+		ca.Register("fail", 10, func() (Value, error) {
+			calls.Inc()
+			return nil, errBackend
+		}, WithNegativeTTL(1))
+		ca.Register("missing", 10, func() (Value, error) {
+			missing.Inc()
+			return nil, ErrNotFound
+		}, WithNegativeTTL(1))
+
+		_, err := ca.Get("fail")
+		So(err, ShouldEqual, errBackend)
+		for i := 0; i < 5; i++ {
+			_, err = ca.Get("fail")
+			var failure *ErrCachedFailure
+			So(errors.As(err, &failure), ShouldBeTrue)
+			So(errors.Is(err, errBackend), ShouldBeTrue)
+		}
+		So(calls.Load(), ShouldEqual, 1)
+
+		for i := 0; i < 5; i++ {
+			v, err := ca.Get("missing")
+			So(v, ShouldBeNil)
+			So(err, ShouldBeNil)
+		}
+		So(missing.Load(), ShouldEqual, 1)
+		So(ca.Stats().NegativeHits, ShouldEqual, 9)
+
+		// 负缓存失效之后不再命中
+		time.Sleep(2100 * time.Millisecond)
+		_, ok := ca.(*cacheImpl).negativeGet("fail")
+		So(ok, ShouldBeFalse)
+
+		// 写入之后负缓存被清除
+		So(ca.Set("fail", StringValue("ok")), ShouldBeNil)
+		v, err := ca.Get("fail")
+		So(err, ShouldBeNil)
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "ok")
+	})
+}
+
+func TestCacheImpl_NegativeLimit(t *testing.T) {
+	Convey("test negative cache should be swept and counted in limits ", t, func() {
+		ca := New(1<<20, time.Hour, nil, WithMaxEntries(3)).(*cacheImpl)
+		ca.RegisterPattern("missing:{id}", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return nil, ErrNotFound
+		}, WithNegativeTTL(1))
+		ca.Set("k1", StringValue("v1"))
+		ca.Set("k2", StringValue("v2"))
+
+		Convey("negative should be evicted before entries ", func() {
+			for i := 0; i < 5; i++ {
+				ca.Get(fmt.Sprintf("missing:%d", i))
+			}
+			So(len(ca.negatives), ShouldEqual, 1)
+			So(len(ca.cache), ShouldEqual, 2)
+			So(ca.negativeBytes, ShouldEqual, len("missing:0")+negativeOverhead)
+		})
+
+		Convey("expired negative should be swept ", func() {
+			ca.Get("missing:1")
+			time.Sleep(2100 * time.Millisecond)
+			ca.RealDel()
+			So(len(ca.negatives), ShouldEqual, 0)
+			So(ca.negativeBytes, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,467 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errRingCollision 写入的key 和segment 中已有的另一个key 的hash 相同，这个key 只能存放在链表中
+var errRingCollision = errors.New("sCache : off heap hash collision")
+
+// OffHeapConfig 字节存储模式的配置。开启之后 DefaultByteValue 和 DefaultStringValue 不再以
+// *sds 的形式挂在链表上，而是序列化到预先分配好的大块 []byte 环形segment 中，索引是
+// map[uint64]uint32，里面没有任何指针，GC 扫描的时候不需要遍历每一个entry。
+// segment 按照FIFO 的方式淘汰，容量由Capacity 限制，独立于maxBytes、maxEntries 计算，配置了
+// 准入策略的时候淘汰segment 中最旧的entry 之前同样需要经过准入策略。hash 冲突的key 以及其他
+// 类型的Value 依然走原来的存储
+type OffHeapConfig struct {
+	// 所有segment 的总容量，单个segment 不能超过4GB，小于等于0 的时候为64MB。超过单个segment
+	// 容量的值依然走原来的存储
+	Capacity int64
+
+	// segment 的数量，key 按照hash 分散到不同的segment，每个segment 有自己的锁，默认16，
+	// 不会超过Capacity
+	Segments int
+
+	// 为true 的时候Get 直接返回segment 中的切片而不是拷贝，减少一次内存分配。返回的切片在释放
+	// segment 的锁之后依然指向segment，之后任何写入都可能在调用者读取的同时覆盖这段内存，这是一个
+	// 数据竞争，只有在读取期间没有写入的场景（例如预热之后只读）才可以开启，调用者也不能修改返回
+	// 的内容。string 类型以及压缩、加密过的值总是拷贝
+	View bool
+}
+
+// entry 头部： expire(8) | hash(8) | keyLen(2) | valLen(4) | flags(1)
+const ringHeaderSize = 23
+
+const (
+	ringFlagDeleted    uint8 = 1 << 7
+	ringFlagCompressed uint8 = 1 << 4 // 值经过了压缩，读取出来之后是 *packedValue
+	ringFlagSealed     uint8 = 1 << 5 // 值经过了加密，读取出来之后是 *packedValue
+
+	ringKindBytes  uint8 = 1
+	ringKindString uint8 = 2
+	ringKindMask   uint8 = 0x0f
+)
+
+type offHeapStore struct {
+	segments []*ringSegment
+	view     bool
+
+	// grace 返回key 过期之后还可以继续读取的秒数，用于regulation 的stale 窗口，可以为nil
+	grace func(key string) int64
+
+	// admit 写入新key 需要淘汰victim 的时候调用，返回false 的时候拒绝写入，可以为nil
+	admit func(candidate, victim string) bool
+}
+
+// defaultOffHeapCapacity 没有设置Capacity 的时候所有segment 的总容量
+const defaultOffHeapCapacity = 64 << 20
+
+func newOffHeapStore(cfg OffHeapConfig) *offHeapStore {
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = defaultOffHeapCapacity
+	}
+	if cfg.Segments <= 0 {
+		cfg.Segments = 16
+	}
+	if int64(cfg.Segments) > cfg.Capacity {
+		cfg.Segments = int(cfg.Capacity)
+	}
+	size := cfg.Capacity / int64(cfg.Segments)
+	if size > 1<<32-1 {
+		size = 1<<32 - 1
+	}
+	s := &offHeapStore{
+		segments: make([]*ringSegment, cfg.Segments),
+		view:     cfg.View,
+	}
+	for i := range s.segments {
+		s.segments[i] = &ringSegment{
+			buf:   make([]byte, size),
+			index: map[uint64]uint32{},
+		}
+	}
+	return s
+}
+
+// ringEntry 被淘汰或者过期的entry，用于回调OnCaller
+type ringEntry struct {
+	key   string
+	value Value
+}
+
+// offHeapPayload 判断value 是否可以放到segment 中存储
+func offHeapPayload(value Value) ([]byte, uint8, bool) {
+	switch v := value.(type) {
+	case *DefaultByteValue:
+		return v.cot, ringKindBytes, true
+	case *DefaultStringValue:
+		return []byte(v.cot), ringKindString, true
+	case *packedValue:
+		kind := v.kind
+		if v.compressed {
+			kind |= ringFlagCompressed
+		}
+		if v.sealed {
+			kind |= ringFlagSealed
+		}
+		return v.cot, kind, true
+	}
+	return nil, 0, false
+}
+
+func (s *offHeapStore) segment(h uint64) *ringSegment {
+	return s.segments[h%uint64(len(s.segments))]
+}
+
+// set 写入一个entry，collect 为true 的时候返回因为空间不足被淘汰的entry
+func (s *offHeapStore) set(key string, data []byte, kind uint8, expire int, collect bool) ([]ringEntry, error) {
+	var ts int64
+	if expire > 0 {
+		ts = time.Now().Unix() + int64(expire)
+	}
+	h := hashKey(key)
+	var admit func(victim string) bool
+	if s.admit != nil {
+		admit = func(victim string) bool {
+			return s.admit(key, victim)
+		}
+	}
+	return s.segment(h).set(h, key, data, kind, ts, collect, admit)
+}
+
+// get 获取一个entry 以及它的过期时间，entry 过期的时候expired 返回true：
+//  1. 还在grace 窗口内的时候ok 为true，value 是过期的值
+//  2. 超过了grace 窗口的时候entry 会被标记删除，ok 为false，value 是过期的值，用于回调
+func (s *offHeapStore) get(key string) (value Value, expire int64, ok bool, expired bool) {
+	h := hashKey(key)
+	data, kind, expire, ok, expired := s.segment(h).get(h, key, !s.view, s.grace)
+	if !ok && !expired {
+		return nil, 0, false, false
+	}
+	return ringValue(data, kind), expire, ok, expired
+}
+
+func (s *offHeapStore) del(key string) (Value, bool) {
+	h := hashKey(key)
+	data, kind, ok := s.segment(h).del(h, key)
+	if !ok {
+		return nil, false
+	}
+	return ringValue(data, kind), true
+}
+
+func (s *offHeapStore) expire(key string, ttl int) bool {
+	h := hashKey(key)
+	return s.segment(h).expire(h, key, time.Now().Unix()+int64(ttl))
+}
+
+// reset 清空所有的segment，collect 为true 的时候返回被清空的entry
+func (s *offHeapStore) reset(collect bool) []ringEntry {
+	var res []ringEntry
+	for _, seg := range s.segments {
+		seg.mu.Lock()
+		if collect {
+			res = append(res, seg.live()...)
+		}
+		seg.index = map[uint64]uint32{}
+		seg.head, seg.tail, seg.entries = 0, 0, 0
+		seg.mu.Unlock()
+	}
+	return res
+}
+
+// live 返回所有segment 中还没有被删除的entry
+func (s *offHeapStore) live() []ringEntry {
+	var res []ringEntry
+	for _, seg := range s.segments {
+		seg.mu.Lock()
+		res = append(res, seg.live()...)
+		seg.mu.Unlock()
+	}
+	return res
+}
+
+// stat 返回entry 数量、占用字节数以及被淘汰的entry 数量
+func (s *offHeapStore) stat() (entries, bytes, evictions int64) {
+	for _, seg := range s.segments {
+		seg.mu.Lock()
+		entries += int64(seg.entries)
+		bytes += seg.tail - seg.head
+		evictions += seg.evictions
+		seg.mu.Unlock()
+	}
+	return
+}
+
+// setOffHeap 将字节类型的值写入segment，并发不安全，需要持有c.rw。返回errRingCollision 或者
+// ErrValueIsBiggerThanMaxByte 的时候链表中的旧值保持不变，由调用者写入链表
+func (c *cacheImpl) setOffHeap(key string, data []byte, kind uint8, expire int) error {
+	evicted, err := c.offHeap.set(key, data, kind, expire, c.OnCaller != nil)
+	if err == ErrAdmissionRejected {
+		c.stats.rejections.Inc()
+	}
+	if err != nil {
+		return err
+	}
+	if ele, ok := c.getElem(key); ok {
+		c.removeElement(ele)
+	}
+	for _, e := range evicted {
+		c.onDelete(e.key, e.value)
+	}
+	return nil
+}
+
+func ringValue(data []byte, kind uint8) Value {
+	if kind&(ringFlagCompressed|ringFlagSealed) != 0 {
+		return &packedValue{
+			cot:        data,
+			kind:       kind & ringKindMask,
+			compressed: kind&ringFlagCompressed != 0,
+			sealed:     kind&ringFlagSealed != 0,
+		}
+	}
+	if kind&ringKindMask == ringKindString {
+		return StringValue(string(data))
+	}
+	return ByteValue(data)
+}
+
+// ringSegment 一个环形的字节数组，head 和tail 是单调递增的逻辑偏移量，对buf 的长度取模之后
+// 才是实际的位置，[head ,tail) 之间是还没有被淘汰的entry，entry 可以跨越buf 的末尾写入
+type ringSegment struct {
+	mu    sync.Mutex
+	buf   []byte
+	index map[uint64]uint32
+
+	head, tail int64
+	entries    int
+	evictions  int64
+}
+
+// set 写入一个entry，hash 相同但key 不同的时候返回errRingCollision，需要淘汰其他entry 的时候
+// 先经过admit，admit 为nil 的时候总是允许写入
+func (r *ringSegment) set(h uint64, key string, data []byte, kind uint8, expire int64, collect bool, admit func(victim string) bool) ([]ringEntry, error) {
+	size := int64(ringHeaderSize + len(key) + len(data))
+	if size > int64(len(r.buf)) || len(key) > 1<<16-1 {
+		return nil, ErrValueIsBiggerThanMaxByte
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off, ok := r.index[h]; ok {
+		_, _, keyLen, _, _ := r.header(off)
+		if !r.keyEqual(off, key, keyLen) {
+			return nil, errRingCollision
+		}
+		r.markDeleted(off)
+		delete(r.index, h)
+		r.entries--
+	} else if admit != nil && r.tail-r.head+size > int64(len(r.buf)) {
+		if victim, ok := r.oldest(); ok && !admit(victim) {
+			return nil, ErrAdmissionRejected
+		}
+	}
+	var evicted []ringEntry
+	for r.tail-r.head+size > int64(len(r.buf)) {
+		if e, ok := r.evictOldest(collect); ok && collect {
+			evicted = append(evicted, e)
+		}
+	}
+	var hdr [ringHeaderSize]byte
+	binary.LittleEndian.PutUint64(hdr[0:], uint64(expire))
+	binary.LittleEndian.PutUint64(hdr[8:], h)
+	binary.LittleEndian.PutUint16(hdr[16:], uint16(len(key)))
+	binary.LittleEndian.PutUint32(hdr[18:], uint32(len(data)))
+	hdr[22] = kind
+	off := r.phys(r.tail)
+	r.write(off, hdr[:])
+	r.write(r.phys(r.tail+ringHeaderSize), []byte(key))
+	r.write(r.phys(r.tail+ringHeaderSize+int64(len(key))), data)
+	r.index[h] = uint32(off)
+	r.tail += size
+	r.entries++
+	return evicted, nil
+}
+
+func (r *ringSegment) get(h uint64, key string, copyValue bool, grace func(string) int64) (data []byte, kind uint8, exp int64, ok bool, expired bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	off, ok := r.index[h]
+	if !ok {
+		return nil, 0, 0, false, false
+	}
+	exp, _, keyLen, valLen, flags := r.header(off)
+	if !r.keyEqual(off, key, keyLen) {
+		// hash 冲突，当作不存在处理
+		return nil, 0, 0, false, false
+	}
+	start := int64(off) + ringHeaderSize + int64(keyLen)
+	kind = flags &^ ringFlagDeleted
+	// 压缩、加密过的值在释放锁之后才会被解压、解密，需要拷贝出来
+	copyValue = copyValue || kind&(ringFlagCompressed|ringFlagSealed) != 0
+	if now := time.Now().Unix(); exp != 0 && exp < now {
+		if grace != nil && exp+grace(key) >= now {
+			return r.read(start, int64(valLen), copyValue), kind, exp, true, true
+		}
+		// 过期的时候将值拷贝出来，用于回调OnCaller
+		r.markDeleted(off)
+		delete(r.index, h)
+		r.entries--
+		return r.read(start, int64(valLen), true), kind, exp, false, true
+	}
+	return r.read(start, int64(valLen), copyValue), kind, exp, true, false
+}
+
+func (r *ringSegment) del(h uint64, key string) ([]byte, uint8, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	off, ok := r.index[h]
+	if !ok {
+		return nil, 0, false
+	}
+	_, _, keyLen, valLen, flags := r.header(off)
+	if !r.keyEqual(off, key, keyLen) {
+		return nil, 0, false
+	}
+	r.markDeleted(off)
+	delete(r.index, h)
+	r.entries--
+	return r.read(int64(off)+ringHeaderSize+int64(keyLen), int64(valLen), true), flags &^ ringFlagDeleted, true
+}
+
+func (r *ringSegment) expire(h uint64, key string, ts int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	off, ok := r.index[h]
+	if !ok {
+		return false
+	}
+	_, _, keyLen, _, _ := r.header(off)
+	if !r.keyEqual(off, key, keyLen) {
+		return false
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(ts))
+	r.write(off, b[:])
+	return true
+}
+
+// live 按照写入顺序返回所有还没有被删除的entry，key 和值都是拷贝
+func (r *ringSegment) live() []ringEntry {
+	res := make([]ringEntry, 0, r.entries)
+	for pos := r.head; pos < r.tail; {
+		off := r.phys(pos)
+		_, h, keyLen, valLen, flags := r.header(off)
+		if idx, ok := r.index[h]; ok && idx == off && flags&ringFlagDeleted == 0 {
+			start := int64(off) + ringHeaderSize
+			res = append(res, ringEntry{
+				key:   string(r.read(start, int64(keyLen), true)),
+				value: ringValue(r.read(start+int64(keyLen), int64(valLen), true), flags),
+			})
+		}
+		pos += int64(ringHeaderSize) + int64(keyLen) + int64(valLen)
+	}
+	return res
+}
+
+// oldest 返回下一个会被淘汰的还没有被删除的key
+func (r *ringSegment) oldest() (string, bool) {
+	for pos := r.head; pos < r.tail; {
+		off := r.phys(pos)
+		_, h, keyLen, valLen, flags := r.header(off)
+		if idx, ok := r.index[h]; ok && idx == off && flags&ringFlagDeleted == 0 {
+			return string(r.read(int64(off)+ringHeaderSize, int64(keyLen), true)), true
+		}
+		pos += int64(ringHeaderSize) + int64(keyLen) + int64(valLen)
+	}
+	return "", false
+}
+
+// evictOldest 淘汰head 位置的entry，已经被标记删除的entry 只回收空间
+func (r *ringSegment) evictOldest(collect bool) (ringEntry, bool) {
+	off := r.phys(r.head)
+	_, h, keyLen, valLen, flags := r.header(off)
+	size := int64(ringHeaderSize) + int64(keyLen) + int64(valLen)
+
+	var e ringEntry
+	live := flags&ringFlagDeleted == 0
+	if idx, ok := r.index[h]; live && ok && idx == off {
+		delete(r.index, h)
+		r.entries--
+		r.evictions++
+		if collect {
+			e.key = string(r.read(int64(off)+ringHeaderSize, int64(keyLen), true))
+			e.value = ringValue(r.read(int64(off)+ringHeaderSize+int64(keyLen), int64(valLen), true), flags)
+		}
+	} else {
+		live = false
+	}
+	r.head += size
+	return e, live
+}
+
+func (r *ringSegment) header(off uint32) (expire int64, hash uint64, keyLen uint16, valLen uint32, flags uint8) {
+	hdr := r.read(int64(off), ringHeaderSize, false)
+	expire = int64(binary.LittleEndian.Uint64(hdr[0:]))
+	hash = binary.LittleEndian.Uint64(hdr[8:])
+	keyLen = binary.LittleEndian.Uint16(hdr[16:])
+	valLen = binary.LittleEndian.Uint32(hdr[18:])
+	flags = hdr[22]
+	return
+}
+
+func (r *ringSegment) markDeleted(off uint32) {
+	p := r.phys(int64(off) + ringHeaderSize - 1)
+	r.buf[p] |= ringFlagDeleted
+}
+
+func (r *ringSegment) keyEqual(off uint32, key string, keyLen uint16) bool {
+	if int(keyLen) != len(key) {
+		return false
+	}
+	return string(r.read(int64(off)+ringHeaderSize, int64(keyLen), false)) == key
+}
+
+func (r *ringSegment) phys(off int64) uint32 {
+	return uint32(off % int64(len(r.buf)))
+}
+
+// read 从物理位置off 开始读取n 个字节，跨越末尾的时候总是拷贝
+func (r *ringSegment) read(off int64, n int64, copyValue bool) []byte {
+	start := off % int64(len(r.buf))
+	if start+n <= int64(len(r.buf)) {
+		if !copyValue {
+			return r.buf[start : start+n : start+n]
+		}
+		out := make([]byte, n)
+		copy(out, r.buf[start:start+n])
+		return out
+	}
+	out := make([]byte, n)
+	first := copy(out, r.buf[start:])
+	copy(out[first:], r.buf[:n-int64(first)])
+	return out
+}
+
+func (r *ringSegment) write(off uint32, data []byte) {
+	n := copy(r.buf[off:], data)
+	if n < len(data) {
+		copy(r.buf, data[n:])
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_OffHeap(t *testing.T) {
+	Convey("test off heap storage ", t, func() {
+		var deleted []string
+		ca := New(5000, 10*time.Second, func(key string, value Value) {
+			deleted = append(deleted, key)
+		}, WithOffHeap(OffHeapConfig{Capacity: 1 << 16, Segments: 4}))
+
+		Convey("byte and string value should be stored in segment ", func() {
+			So(ca.Set("k1", ByteValue([]byte("steven"))), ShouldBeNil)
+			So(ca.Set("k2", StringValue("handsome")), ShouldBeNil)
+			v1, _ := ca.Get("k1")
+			v2, _ := ca.Get("k2")
+			So(string(v1.(*DefaultByteValue).Value()), ShouldEqual, "steven")
+			So(v2.(*DefaultStringValue).Value(), ShouldEqual, "handsome")
+			st := ca.Stats()
+			So(st.OffHeapEntries, ShouldEqual, 2)
+			So(st.Entries, ShouldEqual, 0)
+		})
+
+		Convey("overwrite should replace the old value ", func() {
+			ca.Set("k1", StringValue("v1"))
+			ca.Set("k1", StringValue("v2"))
+			v, _ := ca.Get("k1")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v2")
+			So(ca.Stats().OffHeapEntries, ShouldEqual, 1)
+		})
+
+		Convey("del should call OnCaller ", func() {
+			ca.Set("k1", StringValue("v1"))
+			ca.Del("k1")
+			v, _ := ca.Get("k1")
+			So(v, ShouldBeNil)
+			So(deleted, ShouldResemble, []string{"k1"})
+		})
+
+		Convey("other value should stay on heap ", func() {
+			type custom struct{ DefaultStringValue }
+			ca.Set("k1", &custom{})
+			ca.Set("k2", StringValue("v2"))
+			st := ca.Stats()
+			So(st.Entries, ShouldEqual, 1)
+			So(st.OffHeapEntries, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestRingSegment_Evict(t *testing.T) {
+	Convey("test segment FIFO eviction ", t, func() {
+		store := newOffHeapStore(OffHeapConfig{Capacity: 200, Segments: 1})
+		entry := int64(ringHeaderSize + 5 + 10)
+		for i := 0; i < 20; i++ {
+			_, err := store.set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value%05d", i)), ringKindBytes, 0, false)
+			So(err, ShouldBeNil)
+		}
+		entries, used, evictions := store.stat()
+		So(entries, ShouldEqual, 200/entry)
+		So(used, ShouldEqual, entries*entry)
+		So(evictions, ShouldEqual, 20-entries)
+
+		Convey("the newest entries survive across the wrap ", func() {
+			for i := 0; i < 20; i++ {
+				v, _, ok, _ := store.get(fmt.Sprintf("key%02d", i))
+				if int64(i) < 20-entries {
+					So(ok, ShouldBeFalse)
+					continue
+				}
+				So(ok, ShouldBeTrue)
+				So(string(v.(*DefaultByteValue).Value()), ShouldEqual, fmt.Sprintf("value%05d", i))
+			}
+		})
+
+		Convey("evicted entries should be collected ", func() {
+			evicted, _ := store.set("key99", []byte("value00099"), ringKindBytes, 0, true)
+			So(len(evicted), ShouldEqual, 1)
+			So(evicted[0].key, ShouldEqual, fmt.Sprintf("key%02d", 20-entries))
+		})
+
+		Convey("too big value should be rejected ", func() {
+			_, err := store.set("big", make([]byte, 200), ringKindBytes, 0, false)
+			So(err, ShouldEqual, ErrValueIsBiggerThanMaxByte)
+		})
+	})
+}
+
+func TestRingSegment_Expire(t *testing.T) {
+	Convey("test segment expire ", t, func() {
+		store := newOffHeapStore(OffHeapConfig{Capacity: 1024, Segments: 1})
+		store.set("key", []byte("value"), ringKindString, 0, false)
+		So(store.expire("key", -1), ShouldBeTrue)
+		v, _, ok, expired := store.get("key")
+		So(ok, ShouldBeFalse)
+		So(expired, ShouldBeTrue)
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "value")
+		entries, _, _ := store.stat()
+		So(entries, ShouldEqual, 0)
+	})
+}
+
+// rejectAll 拒绝所有需要淘汰其他key 的写入
+type rejectAll struct{}
+
+func (rejectAll) Record(key string)                   {}
+func (rejectAll) Admit(candidate, victim string) bool { return false }
+
+func TestCacheImpl_OffHeapCollision(t *testing.T) {
+	Convey("test off heap hash collision and admission ", t, func() {
+		Convey("collided key should be stored in list ", func() {
+			ca := New(5000, 10*time.Second, nil, WithOffHeap(OffHeapConfig{Capacity: 1 << 16, Segments: 1})).(*cacheImpl)
+			h := hashKey("k2")
+			_, err := ca.offHeap.segment(h).set(h, "other", []byte("v1"), ringKindString, 0, false, nil)
+			So(err, ShouldBeNil)
+			So(ca.Set("k2", StringValue("v2")), ShouldBeNil)
+
+			v, err := ca.Get("k2")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v2")
+			data, _, _, ok, _ := ca.offHeap.segment(h).get(h, "other", true, nil)
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "v1")
+			st := ca.Stats()
+			So(st.Entries, ShouldEqual, 1)
+			So(st.OffHeapEntries, ShouldEqual, 1)
+		})
+
+		Convey("segment eviction should go through admission ", func() {
+			entry := ringHeaderSize + 2 + 5
+			ca := New(5000, 10*time.Second, nil, WithAdmission(rejectAll{}),
+				WithOffHeap(OffHeapConfig{Capacity: int64(2 * entry), Segments: 1}))
+			So(ca.Set("k1", StringValue("value")), ShouldBeNil)
+			So(ca.Set("k2", StringValue("value")), ShouldBeNil)
+			So(ca.Set("k3", StringValue("value")), ShouldEqual, ErrAdmissionRejected)
+			st := ca.Stats()
+			So(st.Rejections, ShouldEqual, 1)
+			So(st.OffHeapEntries, ShouldEqual, 2)
+		})
+
+		Convey("value bigger than a segment should be stored in list ", func() {
+			ca := New(1<<20, 10*time.Second, nil, WithOffHeap(OffHeapConfig{Capacity: 1 << 16, Segments: 4}))
+			big := StringValue(string(make([]byte, 1<<15)))
+			So(ca.Set("big", big), ShouldBeNil)
+			v, err := ca.Get("big")
+			So(err, ShouldBeNil)
+			So(len(v.(*DefaultStringValue).Value()), ShouldEqual, 1<<15)
+			st := ca.Stats()
+			So(st.Entries, ShouldEqual, 1)
+			So(st.OffHeapEntries, ShouldEqual, 0)
+			So(ca.Set("huge", StringValue(string(make([]byte, 1<<21)))), ShouldEqual, ErrValueIsBiggerThanMaxByte)
+		})
+
+		Convey("zero config should use the default capacity ", func() {
+			ca := New(1<<20, 10*time.Second, nil, WithOffHeap(OffHeapConfig{}))
+			So(ca.Set("a", StringValue("x")), ShouldBeNil)
+			So(ca.Stats().OffHeapEntries, ShouldEqual, 1)
+		})
+	})
+}
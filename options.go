@@ -11,4 +11,118 @@
  * limitations under the License.
  */
 
-package Scache
\ No newline at end of file
+package Scache
+
+import "compress/flate"
+
+// Option 在New 的时候对cache 进行额外的配置，不传的时候保持默认行为
+type Option func(c *cacheImpl)
+
+// WithAccounting 设置内存统计方式，默认为 AccountingPayload
+func WithAccounting(mode AccountingMode) Option {
+	return func(c *cacheImpl) {
+		c.accounting = mode
+	}
+}
+
+// WithMaxEntries 设置最多可以存放的entry 数量，和maxBytes 同时生效，任意一个超出都会触发淘汰
+func WithMaxEntries(n int64) Option {
+	return func(c *cacheImpl) {
+		c.maxEntries = n
+	}
+}
+
+// WithMemoryGovernor 开启内存水位调节，在进程内存紧张的时候自动调低maxBytes，压力下降之后再恢复
+func WithMemoryGovernor(cfg GovernorConfig) Option {
+	return func(c *cacheImpl) {
+		c.governor = newMemoryGovernor(c, cfg)
+	}
+}
+
+// WithAdmission 设置准入策略，写入新key 需要淘汰旧key 的时候，由准入策略决定是否允许写入，
+// 被拒绝的写入会返回 ErrAdmissionRejected
+func WithAdmission(a Admission) Option {
+	return func(c *cacheImpl) {
+		c.admission = a
+	}
+}
+
+// WithOffHeap 开启字节存储模式，DefaultByteValue 和 DefaultStringValue 会被存储到预先分配的
+// 大块内存中，降低GC 扫描的开销
+func WithOffHeap(cfg OffHeapConfig) Option {
+	return func(c *cacheImpl) {
+		c.offHeap = newOffHeapStore(cfg)
+	}
+}
+
+// WithCompression 开启压缩，超过threshold 字节的 DefaultByteValue 和 DefaultStringValue 会被
+// 压缩之后再存储，Get 的时候自动解压，comp 为nil 的时候使用默认级别的flate
+func WithCompression(threshold int, comp Compressor) Option {
+	return func(c *cacheImpl) {
+		if comp == nil {
+			comp = NewFlateCompressor(flate.DefaultCompression)
+		}
+		c.compressor = comp
+		c.compressThreshold = threshold
+	}
+}
+
+// WithCipher 开启加密，DefaultByteValue 和 DefaultStringValue 在存储之前会被加密，Get 的时候
+// 自动解密，同时开启压缩的时候先压缩再加密
+func WithCipher(cipher Cipher) Option {
+	return func(c *cacheImpl) {
+		c.cipher = cipher
+	}
+}
+
+// WithCodec 设置SetObject、GetObject、RegisterObject 使用的编解码方式，默认为JSONCodec
+func WithCodec(codec Codec) Option {
+	return func(c *cacheImpl) {
+		c.codec = codec
+	}
+}
+
+// WithFairShare 设置多个命名空间共享全局容量时的策略，默认为 FairShareStrict
+func WithFairShare(policy FairSharePolicy) Option {
+	return func(c *cacheImpl) {
+		c.fairShare = policy
+	}
+}
+
+// WithLoaderLimit 限制同时执行的所有慢函数的权重之和，limit.MaxWeight 小于等于0 的时候不限制
+func WithLoaderLimit(limit LoaderLimit) Option {
+	return func(c *cacheImpl) {
+		if limit.MaxWeight > 0 {
+			c.bulkheads.global = newSemaphore("", limit)
+		}
+	}
+}
+
+// WithLoaderGroup 限制同一个分组中同时执行的慢函数的权重之和，regulation 通过 WithBulkhead 加入分组，
+// 同时受到 WithLoaderLimit 的限制
+func WithLoaderGroup(group string, limit LoaderLimit) Option {
+	return func(c *cacheImpl) {
+		if limit.MaxWeight > 0 {
+			c.bulkheads.groups[group] = newSemaphore(group, limit)
+		}
+	}
+}
+
+// WithHostSingleFlight 开启同一台机器上多个进程之间的singleFlight，见 HostFlightConfig。cfg.Dir 为空
+// 的时候panic，Dir 无法创建或者当前平台不支持文件锁的时候交给OnError 处理，只在进程内合并请求
+func WithHostSingleFlight(cfg HostFlightConfig) Option {
+	return func(c *cacheImpl) {
+		h, err := newHostFlight(cfg)
+		if err == ErrInValidParam {
+			panic(err)
+		}
+		if err != nil {
+			c.OnError("host single flight is disabled", err)
+			return
+		}
+		h.onError = func(v ...interface{}) {
+			c.OnError(v...)
+		}
+		c.hostFlight = h
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pattern 带有通配符的regulation，支持两种通配符：
+//  1. {name} 匹配一段不包含 : 的非空字符，匹配到的内容会以name 为key 放入params
+//  2. * 匹配任意字符，包括空字符以及 :
+//
+// 多个pattern 都能匹配同一个key 的时候，字面字符多的优先，其次是 * 少的优先，最后按照注册顺序
+type pattern struct {
+	*regular
+	expr  string
+	re    *regexp.Regexp
+	names []string
+	load  func(ctx context.Context, key string, params map[string]string) (Value, error)
+
+	literal int
+	globs   int
+}
+
+// compilePattern 将pattern 编译成正则，pattern 不包含通配符或者格式错误的时候返回ErrInValidParam
+func compilePattern(expr string) (*pattern, error) {
+	p := &pattern{expr: expr}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '*':
+			p.globs++
+			b.WriteString(".*")
+		case '{':
+			end := strings.IndexByte(expr[i:], '}')
+			if end <= 1 {
+				return nil, ErrInValidParam
+			}
+			p.names = append(p.names, expr[i+1:i+end])
+			b.WriteString("([^:]+)")
+			i += end
+		default:
+			p.literal++
+			b.WriteString(regexp.QuoteMeta(expr[i : i+1]))
+		}
+	}
+	if p.globs == 0 && len(p.names) == 0 {
+		return nil, ErrInValidParam
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, ErrInValidParam
+	}
+	p.re = re
+	return p, nil
+}
+
+// match 判断key 是否匹配，匹配的时候返回占位符对应的参数
+func (p *pattern) match(key string) (map[string]string, bool) {
+	sub := p.re.FindStringSubmatch(key)
+	if sub == nil {
+		return nil, false
+	}
+	params := make(map[string]string, len(p.names))
+	for i, name := range p.names {
+		params[name] = sub[i+1]
+	}
+	return params, true
+}
+
+// sortPatterns 按照优先级对pattern 排序，稳定排序保证优先级相同的时候先注册的在前面
+func sortPatterns(patterns []*pattern) {
+	sort.SliceStable(patterns, func(i, j int) bool {
+		if patterns[i].literal != patterns[j].literal {
+			return patterns[i].literal > patterns[j].literal
+		}
+		return patterns[i].globs < patterns[j].globs
+	})
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_RegisterPattern(t *testing.T) {
+	Convey("test load keys matched by pattern ", t, func() {
+		ca := New(1<<20, time.Hour, nil)
+		ca.RegisterPattern("user:{id}", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return StringValue("user " + params["id"]), nil
+		})
+		ca.RegisterPattern("user:*", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return StringValue("glob " + key), nil
+		})
+		ca.RegisterPattern("user:{id}:profile", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return StringValue("profile " + params["id"]), nil
+		})
+		ca.Register("user:admin", 10, func() (Value, error) {
+			return StringValue("admin"), nil
+		})
+
+		for key, want := range map[string]string{
+			"user:123":         "user 123",
+			"user:1:profile":   "profile 1",
+			"user:1:orders":    "glob user:1:orders",
+			"user:":            "glob user:",
+			"user:admin":       "admin",
+			"user:admin:other": "glob user:admin:other",
+		} {
+			v, err := ca.Get(key)
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, want)
+		}
+		v, err := ca.Get("order:1")
+		So(err, ShouldBeNil)
+		So(v, ShouldBeNil)
+
+		So(func() { ca.RegisterPattern("user:*", 10, nil) }, ShouldPanic)
+		So(func() {
+			ca.RegisterPattern("user:*", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+				return nil, nil
+			})
+		}, ShouldPanicWith, ErrRegulationAlreadyExist)
+		So(func() {
+			ca.RegisterPattern("user:{id", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+				return nil, nil
+			})
+		}, ShouldPanicWith, ErrInValidParam)
+	})
+
+	Convey("test concurrent loads are deduplicated per key ", t, func() {
+		var calls atomic.Int32
+		ca := New(1<<20, time.Hour, nil)
+		ca.RegisterPattern("item:{id}", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			calls.Inc()
+			time.Sleep(200 * time.Millisecond)
+			return StringValue(params["id"]), nil
+		})
+		wg := sync.WaitGroup{}
+		for i := 0; i < 40; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ca.Get(fmt.Sprintf("item:%d", i%2))
+			}(i)
+		}
+		wg.Wait()
+		So(calls.Load(), ShouldEqual, 2)
+	})
+
+	Convey("test pattern in namespace ", t, func() {
+		ca := New(1<<20, time.Hour, nil)
+		ns := ca.Namespace("tenant", NamespaceQuota{})
+		ns.RegisterPattern("user:{id}", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return StringValue(key), nil
+		})
+		v, err := ns.Get("user:7")
+		So(err, ShouldBeNil)
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "user:7")
+	})
+}
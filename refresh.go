@@ -0,0 +1,107 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// staleForever 熔断器打开的时候过期的值可以一直作为旧值返回
+const staleForever = int64(1) << 40
+
+// regulationRef 缓存在sds 上的regulation，gen 和regularManger 的gen 不一致的时候需要重新查询
+type regulationRef struct {
+	reg *regular
+	gen int64
+}
+
+// staleRegulationRef 被回收的sds 上的regulation，总是需要重新查询
+var staleRegulationRef = &regulationRef{gen: -1}
+
+// regulationOf 返回key 对应的regulation，不是regulation 的时候返回nil。sd 不为nil 的时候查询结果
+// 缓存在sd 上，命中的时候不需要再去匹配pattern
+func (c *cacheImpl) regulationOf(key string, sd *sds) *regular {
+	if sd != nil {
+		if ref, ok := sd.reg.Load().(*regulationRef); ok && ref.gen == c.regularManger.gen.Load() {
+			return ref.reg
+		}
+	}
+	reg, gen := c.regularManger.resolve(key)
+	if sd != nil {
+		sd.reg.Store(&regulationRef{reg: reg, gen: gen})
+	}
+	return reg
+}
+
+// staleFor 返回key 对应的regulation 过期之后还可以返回旧值的秒数，不是regulation 的时候为0
+func (c *cacheImpl) staleFor(key string) int64 {
+	return c.staleOf(c.regulationOf(key, nil))
+}
+
+// staleOf 同staleFor，reg 为nil 的时候为0
+func (c *cacheImpl) staleOf(reg *regular) int64 {
+	if reg == nil {
+		return 0
+	}
+	if reg.breaker != nil && reg.breaker.State() != BreakerClosed {
+		return staleForever
+	}
+	return int64(reg.opts.StaleFor)
+}
+
+// refreshAhead 按照XFetch 算法判断是否需要提前刷新，expire 是值的过期时间。只有剩余有效期进入
+// expire*RefreshAhead 的窗口之后才会判断，满足 -delta*beta*ln(rand) >= 剩余有效期 的时候刷新，
+// delta 是最近一次慢函数的耗时
+func (c *cacheImpl) refreshAhead(reg *regular, expire int64) bool {
+	if reg == nil || reg.opts.RefreshAhead <= 0 {
+		return false
+	}
+	delta := time.Duration(reg.delta.Load())
+	if delta <= 0 {
+		return false
+	}
+	remaining := float64(expire) - float64(time.Now().UnixNano())/float64(time.Second)
+	if remaining <= 0 || remaining > reg.opts.RefreshAhead*float64(reg.expire) {
+		return false
+	}
+	gap := -delta.Seconds() * reg.opts.RefreshBeta * math.Log(1-rand.Float64())
+	return gap >= remaining
+}
+
+// revalidate 在后台通过singleFlight 重新加载regulation，同一个key 同一时间只会有一个刷新在执行，
+// 加载失败的时候交给OnError 处理，旧值会继续返回直到stale 窗口结束。已经有刷新在执行的时候
+// 返回false
+func (c *cacheImpl) revalidate(key string) bool {
+	if _, loaded := c.refreshing.LoadOrStore(key, struct{}{}); loaded {
+		return false
+	}
+	go func() {
+		defer c.refreshing.Delete(key)
+		val, shouldSave, expire, err := c.regularManger.Get(key)
+		if err != nil {
+			// 熔断期间每次返回旧值都会触发刷新，不需要重复报告
+			if c.OnError != nil && err != ErrCircuitOpen {
+				c.OnError(fmt.Sprintf("revalidate regulation %s", key), err)
+			}
+			return
+		}
+		if shouldSave && val != nil {
+			c.set(key, val, expire)
+		}
+	}()
+	return true
+}
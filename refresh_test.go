@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_StaleWhileRevalidate(t *testing.T) {
+	Convey("test serve stale value while revalidating ", t, func() {
+		var version atomic.Int32
+		loader := func() (Value, error) {
+			time.Sleep(500 * time.Millisecond)
+			return StringValue(fmt.Sprintf("v%d", version.Inc())), nil
+		}
+		for _, offHeap := range []bool{false, true} {
+			var opts []Option
+			if offHeap {
+				opts = append(opts, WithOffHeap(OffHeapConfig{Capacity: 1 << 16}))
+			}
+			version.Store(0)
+			ca := New(1<<20, time.Hour, nil, opts...)
+			ca.Register("stale", 1, loader, WithStaleFor(2))
+
+			v, err := ca.Get("stale")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v1")
+			time.Sleep(2100 * time.Millisecond)
+
+			start := time.Now()
+			v, _ = ca.Get("stale")
+			So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v1")
+			v, _ = ca.Get("stale")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v1")
+			So(ca.Stats().StaleServes, ShouldEqual, 2)
+
+			time.Sleep(700 * time.Millisecond)
+			v, _ = ca.Get("stale")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v2")
+			So(version.Load(), ShouldEqual, 2)
+		}
+	})
+}
+
+func TestCacheImpl_RefreshAhead(t *testing.T) {
+	Convey("test refresh regulation before it expires ", t, func() {
+		for _, offHeap := range []bool{false, true} {
+			// 上一轮触发的后台刷新可能还在执行，每一轮使用自己的计数器
+			var version atomic.Int32
+			loader := func() (Value, error) {
+				time.Sleep(300 * time.Millisecond)
+				return StringValue(fmt.Sprintf("v%d", version.Inc())), nil
+			}
+			var opts []Option
+			if offHeap {
+				opts = append(opts, WithOffHeap(OffHeapConfig{Capacity: 1 << 16}))
+			}
+			ca := New(1<<20, time.Hour, nil, opts...)
+			ca.Register("ahead", 3, loader, WithRefreshAhead(1, 1000))
+			ca.Register("lazy", 3, loader)
+
+			v, err := ca.Get("ahead")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v1")
+
+			// beta 足够大，窗口内的命中几乎一定会触发提前刷新
+			for i := 0; i < 10 && ca.Stats().RefreshAheads == 0; i++ {
+				v, _ = ca.Get("ahead")
+				So(v.(*DefaultStringValue).Value(), ShouldEqual, "v1")
+			}
+			So(ca.Stats().RefreshAheads, ShouldEqual, 1)
+			// 刷新还在执行的时候命中不会再次计数
+			for i := 0; i < 10; i++ {
+				ca.Get("ahead")
+			}
+			So(ca.Stats().RefreshAheads, ShouldEqual, 1)
+			time.Sleep(500 * time.Millisecond)
+			v, _ = ca.Get("ahead")
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "v2")
+
+			refreshed := ca.Stats().RefreshAheads
+			for i := 0; i < 10; i++ {
+				ca.Get("lazy")
+			}
+			So(ca.Stats().RefreshAheads, ShouldEqual, refreshed)
+		}
+	})
+}
+
+func TestCacheImpl_RegulationOf(t *testing.T) {
+	Convey("test regulation cached on entry ", t, func() {
+		ca := New(1<<20, time.Hour, nil).(*cacheImpl)
+		loader := func() (Value, error) { return StringValue("v"), nil }
+		ca.Register("user", 10, loader)
+		ca.Get("user")
+		sd := ca.cache["user"].Value.(*sds)
+
+		reg := ca.regulationOf("user", sd)
+		So(reg, ShouldNotBeNil)
+		So(ca.regulationOf("user", sd), ShouldEqual, reg)
+
+		Convey("replace should invalidate the cached regulation ", func() {
+			So(ca.Replace("user", 20, loader, false), ShouldBeNil)
+			So(ca.regulationOf("user", sd), ShouldNotEqual, reg)
+			So(ca.regulationOf("user", sd).expire, ShouldEqual, 20)
+		})
+
+		Convey("unregister should invalidate the cached regulation ", func() {
+			So(ca.Unregister("user"), ShouldBeTrue)
+			So(ca.regulationOf("user", sd), ShouldBeNil)
+		})
+	})
+}
@@ -13,59 +13,428 @@
 
 package Scache
 
-import "sync"
+import (
+	"context"
+	"go.uber.org/atomic"
+	"sort"
+	"sync"
+	"time"
+)
 
 // regulation 是用于管理注册用户的狗子函数，本想起名字为hook，但是感觉regulation比较不错
 type regular struct {
-	call   func() (Value, error)
+	call   func(ctx context.Context) (Value, error)
 	expire int
+	opts   RegulationOptions
+
+	// 最近一次慢函数的耗时，单位纳秒
+	delta atomic.Int64
+
+	// 熔断器，没有配置的时候为nil
+	breaker *circuitBreaker
+}
+
+func (reg *regular) weight() int64 {
+	if reg.opts.Weight < 1 {
+		return 1
+	}
+	return reg.opts.Weight
+}
+
+func newRegular(call func(ctx context.Context) (Value, error), expire int, opts []RegulationOption) *regular {
+	reg := &regular{
+		call:   call,
+		expire: expire,
+	}
+	for _, opt := range opts {
+		opt(&reg.opts)
+	}
+	if reg.opts.Breaker != nil {
+		reg.breaker = newCircuitBreaker(*reg.opts.Breaker)
+	}
+	return reg
+}
+
+// RegulationOptions regulation 注册时的可选配置
+type RegulationOptions struct {
+	// StaleFor 值过期之后还可以继续返回旧值的秒数，在这个窗口内Get 会立即返回过期的值，同时在
+	// 后台通过singleFlight 刷新，超过这个窗口之后Get 才会阻塞等待慢函数，为0的时候不开启
+	StaleFor int
+
+	// RefreshAhead 值剩余的有效期小于 expire*RefreshAhead 的时候，Get 会按照XFetch 算法以一定
+	// 的概率提前在后台刷新，慢函数越慢、越接近过期，刷新的概率越大，为0的时候不开启
+	RefreshAhead float64
+
+	// RefreshBeta XFetch 算法中的beta，大于1 的时候倾向于更早刷新，默认为1
+	RefreshBeta float64
+
+	// NegativeTTL 慢函数返回错误或者数据不存在的时候，结果会被缓存NegativeTTL 秒，期间Get 不会再调用
+	// 慢函数，为0的时候不开启。负缓存计入maxBytes 以及maxEntries，超出限制的时候先于entry 被淘汰
+	NegativeTTL int
+
+	// Retry 慢函数失败之后的重试策略，为nil 的时候不重试
+	Retry *RetryPolicy
+
+	// Breaker 熔断器的配置，为nil 的时候不开启
+	Breaker *BreakerPolicy
+
+	// Group 慢函数所属的并发限制分组，Weight 是慢函数执行时占用的权重，默认为1
+	Group  string
+	Weight int64
+
+	// RegisterBatch 收集未命中的key 的时间窗口以及一次加载的最大key 数量，见 WithBatch
+	BatchWindow time.Duration
+	BatchSize   int
+
+	// batch RegisterBatch 注册的pattern，并发许可由批次统一获取，每个key 不再单独获取
+	batch bool
+}
+
+// RegulationInfo regulation 的注册信息以及运行状态
+type RegulationInfo struct {
+	Name         string
+	Expire       int
+	Options      RegulationOptions
+	LoadDuration time.Duration // 最近一次慢函数的耗时
+	Breaker      BreakerState  // 熔断器的状态，没有开启熔断的时候总是closed
+}
+
+// RegulationOption 注册regulation 时对RegulationOptions 进行配置
+type RegulationOption func(o *RegulationOptions)
+
+// WithRefreshAhead 开启提前刷新，见 RegulationOptions.RefreshAhead 和 RegulationOptions.RefreshBeta
+func WithRefreshAhead(fraction, beta float64) RegulationOption {
+	return func(o *RegulationOptions) {
+		if beta <= 0 {
+			beta = 1
+		}
+		o.RefreshAhead = fraction
+		o.RefreshBeta = beta
+	}
+}
+
+// WithNegativeTTL 设置慢函数失败或者数据不存在的结果的缓存秒数，见 RegulationOptions.NegativeTTL
+func WithNegativeTTL(seconds int) RegulationOption {
+	return func(o *RegulationOptions) {
+		o.NegativeTTL = seconds
+	}
+}
+
+// WithBulkhead 将regulation 加入并发限制分组，见 WithLoaderGroup，weight 小于1 的时候为1。RegisterBatch
+// 注册的pattern 每个批次占用一次weight
+func WithBulkhead(group string, weight int64) RegulationOption {
+	return func(o *RegulationOptions) {
+		if weight < 1 {
+			weight = 1
+		}
+		o.Group = group
+		o.Weight = weight
+	}
+}
+
+// WithStaleFor 设置过期之后依然可以返回旧值的秒数，见 RegulationOptions.StaleFor
+func WithStaleFor(seconds int) RegulationOption {
+	return func(o *RegulationOptions) {
+		o.StaleFor = seconds
+	}
 }
 
 type RegularManger interface {
-	Register(regulation string, expire int, call func() (Value, error))
+	Register(regulation string, expire int, call func() (Value, error), opts ...RegulationOption)
+
+	// RegisterContext 同Register，慢函数可以拿到调用者的ctx
+	RegisterContext(regulation string, expire int, call func(ctx context.Context) (Value, error), opts ...RegulationOption)
+
+	// RegisterPattern 注册一个带有通配符的regulation，见 pattern
+	RegisterPattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), opts ...RegulationOption)
+
+	// Unregister 删除regulation 或者pattern，正在执行的慢函数会继续执行完，但结果不会被存储，
+	// regulation 不存在的时候返回false
+	Unregister(regulation string) bool
+
+	// Replace 原子的替换regulation 的慢函数、过期时间以及配置，正在执行的旧的慢函数会继续执行完，
+	// 但结果不会被存储，之后的请求使用新的慢函数。regulation 不存在的时候返回ErrRegulationNotExist
+	Replace(regulation string, expire int, call func(ctx context.Context) (Value, error), opts ...RegulationOption) error
+
+	// ReplacePattern 同Replace，替换的是pattern 的load，pattern 不存在的时候返回ErrRegulationNotExist
+	ReplacePattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), opts ...RegulationOption) error
+
+	// Regulations 按照名称排序返回所有的regulation 以及pattern
+	Regulations() []RegulationInfo
+
+	// Info 返回regulation 的注册信息，key 匹配pattern 的时候返回pattern 的信息，regulation 不存在
+	// 的时候第二个返回值为false
+	Info(regulation string) (RegulationInfo, bool)
 
 	// 第二个参数理解起来有点困难，因为RegularManager 是并发安全的，所以同一时间打入Get方法
 	// 的流量势必会非常多，假设100个流量都进入了Get，在上层调用的时候不应该将所有的请求拿到的
 	// 值都去存储起来，那么在这么多流量选择一个的时候，就可以选择slowPath 返回的路径作为存储
 	Get(regulation string) (Value, bool/* is slow way */, int /* expire time */, error)
+
+	// Breakers 返回所有开启了熔断的regulation 以及熔断器的状态
+	Breakers() map[string]BreakerState
+
+	// GetContext 同Get，ctx 结束的时候立即返回ctx.Err()，慢函数只有在所有等待的调用者都离开之后
+	// 才会被取消
+	GetContext(ctx context.Context, regulation string) (Value, bool, int, error)
 }
 
 type defaultRegularManger struct {
 	rw           *sync.RWMutex
 	set          map[string]*regular
+	patterns     []*pattern
 	singleFlight SingleFlight
+	bulkheads    *bulkheads
+
+	// 同一台机器上多个进程之间的singleFlight，没有开启的时候为nil
+	host *hostFlight
+
+	// regulation 每次注册、替换或者删除的时候加一，缓存在entry 上的regulation 以此判断是否失效
+	gen atomic.Int64
 }
 
 func NewRegularManager() RegularManger {
+	return newRegularManager(&bulkheads{})
+}
+
+func newRegularManager(bh *bulkheads) *defaultRegularManger {
 	return &defaultRegularManger{
 		rw:           &sync.RWMutex{},
 		set:          map[string]*regular{},
 		singleFlight: NewSingleFlight(20),
+		bulkheads:    bh,
 	}
 }
 
-func (r *defaultRegularManger) Register(regulation string, expire int, call func() (Value, error))  {
+func (r *defaultRegularManger) Register(regulation string, expire int, call func() (Value, error), opts ...RegulationOption) {
+	r.RegisterContext(regulation, expire, func(ctx context.Context) (Value, error) {
+		return call()
+	}, opts...)
+}
+
+func (r *defaultRegularManger) RegisterContext(regulation string, expire int, call func(ctx context.Context) (Value, error), opts ...RegulationOption) {
 	r.rw.Lock()
 	defer r.rw.Unlock()
 	if _, ok := r.set[regulation]; ok {
 		panic( ErrRegulationAlreadyExist)
 	}
-	r.set[regulation] = &regular{
-		call:   call,
-		expire: expire,
+	r.set[regulation] = newRegular(call, expire, opts)
+	r.gen.Inc()
+}
+
+func (r *defaultRegularManger) Unregister(regulation string) bool {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	if _, ok := r.set[regulation]; ok {
+		delete(r.set, regulation)
+		r.singleFlight.Forget(regulation)
+		r.gen.Inc()
+		return true
+	}
+	for i, p := range r.patterns {
+		if p.expr == regulation {
+			r.patterns = append(r.patterns[:i:i], r.patterns[i+1:]...)
+			r.gen.Inc()
+			return true
+		}
 	}
+	return false
 }
 
-func (r *defaultRegularManger) Get(regulation string) (Value, bool,int , error) {
+func (r *defaultRegularManger) Replace(regulation string, expire int, call func(ctx context.Context) (Value, error), opts ...RegulationOption) error {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	if _, ok := r.set[regulation]; !ok {
+		return ErrRegulationNotExist
+	}
+	r.set[regulation] = newRegular(call, expire, opts)
+	r.gen.Inc()
+	// 之后的请求不再等待旧的慢函数
+	r.singleFlight.Forget(regulation)
+	return nil
+}
+
+func (r *defaultRegularManger) ReplacePattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), opts ...RegulationOption) error {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	for i, v := range r.patterns {
+		if v.expr == expr {
+			// expr 不变，优先级也不变，不需要重新排序
+			p := *v
+			p.regular = newRegular(nil, expire, opts)
+			p.load = load
+			r.patterns[i] = &p
+			r.gen.Inc()
+			return nil
+		}
+	}
+	return ErrRegulationNotExist
+}
+
+func (r *defaultRegularManger) Regulations() []RegulationInfo {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	res := make([]RegulationInfo, 0, len(r.set)+len(r.patterns))
+	for name, v := range r.set {
+		res = append(res, v.info(name))
+	}
+	for _, p := range r.patterns {
+		res = append(res, p.info(p.expr))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+func (r *defaultRegularManger) RegisterPattern(expr string, expire int, load func(ctx context.Context, key string, params map[string]string) (Value, error), opts ...RegulationOption) {
+	p, err := compilePattern(expr)
+	if err != nil {
+		panic(err)
+	}
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	for _, v := range r.patterns {
+		if v.expr == expr {
+			panic(ErrRegulationAlreadyExist)
+		}
+	}
+	p.regular = newRegular(nil, expire, opts)
+	p.load = load
+	r.patterns = append(r.patterns, p)
+	sortPatterns(r.patterns)
+	r.gen.Inc()
+}
+
+func (r *defaultRegularManger) Info(regulation string) (RegulationInfo, bool) {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	if v, name := r.lookup(regulation); v != nil {
+		return v.info(name), true
+	}
+	return RegulationInfo{}, false
+}
+
+func (r *defaultRegularManger) Breakers() map[string]BreakerState {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	res := map[string]BreakerState{}
+	for name, v := range r.set {
+		if v.breaker != nil {
+			res[name] = v.breaker.State()
+		}
+	}
+	for _, p := range r.patterns {
+		if p.breaker != nil {
+			res[p.expr] = p.breaker.State()
+		}
+	}
+	return res
+}
+
+func (reg *regular) info(name string) RegulationInfo {
+	info := RegulationInfo{
+		Name:         name,
+		Expire:       reg.expire,
+		Options:      reg.opts,
+		LoadDuration: time.Duration(reg.delta.Load()),
+	}
+	if reg.breaker != nil {
+		info.Breaker = reg.breaker.State()
+	}
+	return info
+}
+
+// resolve 返回key 对应的regulation 以及查询时的gen，key 不是regulation 的时候返回nil
+func (r *defaultRegularManger) resolve(key string) (*regular, int64) {
 	r.rw.RLock()
-	v, ok := r.set[regulation]
-	r.rw.RUnlock()
-	if ok {
-		val ,slow ,err :=  r.singleFlight.Get(regulation, v.call)
+	defer r.rw.RUnlock()
+	v, _ := r.lookup(key)
+	return v, r.gen.Load()
+}
+
+// lookup 查找key 对应的regulation，精确注册的优先，其次是按照优先级匹配的pattern，返回值name
+// 是注册时的名称，调用者需要持有读锁
+func (r *defaultRegularManger) lookup(key string) (*regular, string) {
+	if v, ok := r.set[key]; ok {
+		return v, key
+	}
+	for _, p := range r.patterns {
+		if p.re.MatchString(key) {
+			return p.regular, p.expr
+		}
+	}
+	return nil, ""
+}
+
+// slowWay 返回key 对应的慢函数，pattern 的慢函数会带上key 以及匹配到的参数
+func (r *defaultRegularManger) slowWay(key string) (*regular, func(ctx context.Context) (Value, error)) {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	if v, ok := r.set[key]; ok {
+		return v, v.call
+	}
+	for _, p := range r.patterns {
+		if params, ok := p.match(key); ok {
+			load := p.load
+			return p.regular, func(ctx context.Context) (Value, error) {
+				return load(ctx, key, params)
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (r *defaultRegularManger) Get(regulation string) (Value, bool,int , error) {
+	return r.GetContext(context.Background(), regulation)
+}
+
+func (r *defaultRegularManger) GetContext(ctx context.Context, regulation string) (Value, bool, int, error) {
+	v, call := r.slowWay(regulation)
+	if v != nil {
+		// singleFlight 以具体的key 作为topic，同一个pattern 下不同的key 分别加载
+		load := func(ctx context.Context) (Value, error) {
+			if !v.opts.batch {
+				// 排队等待许可的时间不计入慢函数的耗时
+				release, err := r.bulkheads.acquire(ctx, v.opts.Group, v.weight())
+				if err != nil {
+					return nil, err
+				}
+				defer release()
+			}
+			start := time.Now()
+			defer func() {
+				v.delta.Store(int64(time.Since(start)))
+			}()
+			return v.resilient(ctx, call)
+		}
+		val ,slow ,err :=  r.singleFlight.GetContext(ctx, regulation, func(ctx context.Context) (Value, error) {
+			if r.host != nil {
+				// 等待其他进程释放文件锁的时间不占用慢函数的许可
+				return r.host.do(ctx, regulation, v.expire, load)
+			}
+			return load(ctx)
+		})
 		if err != nil {
 			return nil, false, 0, err
 		}
-		return val,slow,v.expire,nil
+		// 加载期间regulation 被替换或者删除的时候，旧的慢函数的结果不再存储
+		if slow && !r.current(regulation, v) {
+			slow = false
+		}
+		expire := v.expire
+		if hv, ok := val.(*hostValue); ok {
+			val, expire = hv.Value, hv.ttl
+		}
+		return val,slow,expire,nil
 	}
 	return nil, false, 0, nil
 }
+
+// current 判断key 对应的regulation 是否依然是v
+func (r *defaultRegularManger) current(key string, v *regular) bool {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	cur, _ := r.lookup(key)
+	return cur == v
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_ReplaceRegulation(t *testing.T) {
+	Convey("test unregister and replace regulation at runtime ", t, func() {
+		ca := New(1<<20, time.Hour, nil)
+		release := make(chan struct{})
+		ca.Register("source", 10, func() (Value, error) {
+			<-release
+			return StringValue("old"), nil
+		})
+		ca.RegisterPattern("user:{id}", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return StringValue(params["id"]), nil
+		})
+
+		infos := ca.Regulations()
+		So(len(infos), ShouldEqual, 2)
+		So(infos[0].Name, ShouldEqual, "source")
+		So(infos[1].Name, ShouldEqual, "user:{id}")
+
+		// 正在执行的旧的慢函数执行完，但结果不会被存储
+		old := make(chan Value, 1)
+		go func() {
+			v, _ := ca.Get("source")
+			old <- v
+		}()
+		time.Sleep(50 * time.Millisecond)
+		So(ca.Replace("source", 10, func() (Value, error) {
+			return StringValue("new"), nil
+		}, true), ShouldBeNil)
+		v, err := ca.Get("source")
+		So(err, ShouldBeNil)
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "new")
+		close(release)
+		So((<-old).(*DefaultStringValue).Value(), ShouldEqual, "old")
+		v, _ = ca.Get("source")
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "new")
+
+		// 替换的时候删除已经缓存的值
+		So(ca.Replace("source", 10, func() (Value, error) {
+			return StringValue("newer"), nil
+		}, true), ShouldBeNil)
+		v, _ = ca.Get("source")
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "newer")
+		So(ca.Replace("missing", 10, func() (Value, error) { return nil, nil }, false), ShouldEqual, ErrRegulationNotExist)
+
+		So(ca.Unregister("user:{id}"), ShouldBeTrue)
+		So(ca.Unregister("user:{id}"), ShouldBeFalse)
+		v, err = ca.Get("user:1")
+		So(err, ShouldBeNil)
+		So(v, ShouldBeNil)
+		So(ca.Unregister("source"), ShouldBeTrue)
+		So(len(ca.Regulations()), ShouldEqual, 0)
+
+		// 删除之后可以重新注册
+		So(func() {
+			ca.Register("source", 10, func() (Value, error) { return StringValue("again"), nil })
+		}, ShouldNotPanic)
+	})
+}
+
+func TestCacheImpl_ReplacePattern(t *testing.T) {
+	Convey("test replace pattern at runtime ", t, func() {
+		var deleted []string
+		ca := New(1<<20, time.Hour, func(key string, value Value) {
+			deleted = append(deleted, key)
+		})
+		ca.RegisterPattern("user:{id}", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return StringValue("old" + params["id"]), nil
+		})
+		ca.Get("user:1")
+		ca.Set("order:1", StringValue("order"))
+
+		So(ca.ReplacePattern("user:{id}", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return StringValue("new" + params["id"]), nil
+		}, true), ShouldBeNil)
+		So(deleted, ShouldResemble, []string{"user:1"})
+		v, _ := ca.Get("user:1")
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "new1")
+		v, _ = ca.Get("order:1")
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "order")
+
+		So(ca.ReplacePattern("order:{id}", 10, func(ctx context.Context, key string, params map[string]string) (Value, error) {
+			return nil, nil
+		}, false), ShouldEqual, ErrRegulationNotExist)
+		So(ca.Replace("user:{id}", 10, func() (Value, error) { return nil, nil }, false), ShouldEqual, ErrRegulationNotExist)
+	})
+}
+
+func TestCacheImpl_ReplaceContext(t *testing.T) {
+	Convey("test context regulation stays cancellable after replace ", t, func() {
+		ca := New(1<<20, time.Hour, nil)
+		ca.RegisterContext("ctx", 10, func(ctx context.Context) (Value, error) {
+			return StringValue("old"), nil
+		})
+		canceled := make(chan struct{})
+		So(ca.ReplaceContext("ctx", 10, func(ctx context.Context) (Value, error) {
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		}, true), ShouldBeNil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := ca.GetContext(ctx, "ctx")
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("replaced loader was not canceled")
+		}
+		So(ca.ReplaceContext("missing", 10, func(ctx context.Context) (Value, error) { return nil, nil }, false), ShouldEqual, ErrRegulationNotExist)
+	})
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen regulation 的熔断器处于打开状态，慢函数没有被调用
+var ErrCircuitOpen = errors.New("sCache : circuit breaker is open")
+
+// errSlowCallPanic 慢函数panic 的时候记录到熔断器中的失败
+var errSlowCallPanic = errors.New("sCache : slow call panic")
+
+// RetryPolicy 慢函数失败之后的重试策略，重试的间隔按照指数增长并带有随机抖动
+type RetryPolicy struct {
+	// Attempts 最多调用慢函数的次数，包含第一次调用
+	Attempts int
+
+	// BaseDelay 第一次重试之前等待的时间，之后每次翻倍，不超过MaxDelay，实际等待的时间在
+	// [delay/2, delay) 之间随机
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Retryable 判断错误是否需要重试，为nil 的时候除了ErrNotFound 和ctx 的错误之外都会重试
+	Retryable func(err error) bool
+}
+
+// BreakerPolicy 熔断器的配置：
+//  1. closed 连续失败Failures 次之后打开
+//  2. open 持续OpenFor，期间直接返回ErrCircuitOpen，过期的值会一直作为旧值返回
+//  3. half-open OpenFor 之后允许HalfOpenProbes 个请求调用慢函数，成功之后关闭，失败之后重新打开
+type BreakerPolicy struct {
+	Failures       int
+	OpenFor        time.Duration
+	HalfOpenProbes int
+}
+
+// BreakerState 熔断器的状态
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// WithRetry 慢函数失败之后按照policy 重试，见 RetryPolicy
+func WithRetry(policy RetryPolicy) RegulationOption {
+	return func(o *RegulationOptions) {
+		if policy.Attempts < 1 {
+			policy.Attempts = 1
+		}
+		o.Retry = &policy
+	}
+}
+
+// WithCircuitBreaker 为regulation 开启熔断，见 BreakerPolicy
+func WithCircuitBreaker(policy BreakerPolicy) RegulationOption {
+	return func(o *RegulationOptions) {
+		if policy.Failures < 1 {
+			policy.Failures = 1
+		}
+		if policy.HalfOpenProbes < 1 {
+			policy.HalfOpenProbes = 1
+		}
+		o.Breaker = &policy
+	}
+}
+
+// retryable 默认的重试判断
+func retryable(policy *RetryPolicy, err error) bool {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if policy.Retryable != nil {
+		return policy.Retryable(err)
+	}
+	return true
+}
+
+// backoff 第attempt 次重试之前需要等待的时间，attempt 从1开始
+func backoff(policy *RetryPolicy, attempt int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && (policy.MaxDelay <= 0 || delay < policy.MaxDelay); i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// withRetry 按照policy 调用call，ctx 结束的时候停止重试
+func withRetry(ctx context.Context, policy *RetryPolicy, call func(ctx context.Context) (Value, error)) (Value, error) {
+	for attempt := 1; ; attempt++ {
+		val, err := call(ctx)
+		if err == nil || attempt >= policy.Attempts || !retryable(policy, err) {
+			return val, err
+		}
+		t := time.NewTimer(backoff(policy, attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+	}
+}
+
+// circuitBreaker regulation 的熔断器，同一个pattern 下的所有key 共用一个熔断器
+type circuitBreaker struct {
+	mu       sync.Mutex
+	policy   BreakerPolicy
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+func newCircuitBreaker(policy BreakerPolicy) *circuitBreaker {
+	return &circuitBreaker{policy: policy}
+}
+
+// allow 判断是否可以调用慢函数，open 超过OpenFor 之后进入half-open，probe 表示占用了一个half-open
+// 的探测名额
+func (b *circuitBreaker) allow() (probe bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.policy.OpenFor {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.policy.HalfOpenProbes {
+			return false, false
+		}
+		b.probes++
+		return true, true
+	}
+	return false, true
+}
+
+// release 慢函数没有给出结果的时候归还allow 占用的half-open 探测名额
+func (b *circuitBreaker) release(probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe && b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// record 记录慢函数的结果，数据不存在不算失败
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || errors.Is(err, ErrNotFound) {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.policy.Failures {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// State 返回当前的状态，open 超过OpenFor 之后返回half-open
+func (b *circuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.policy.OpenFor {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// resilient 在慢函数外面加上熔断和重试
+func (reg *regular) resilient(ctx context.Context, call func(ctx context.Context) (Value, error)) (val Value, err error) {
+	if reg.breaker == nil {
+		return reg.retry(ctx, call)
+	}
+	probe, ok := reg.breaker.allow()
+	if !ok {
+		return nil, ErrCircuitOpen
+	}
+	finished := false
+	defer func() {
+		switch {
+		case !finished:
+			// panic 算作慢函数的失败，panic 本身继续交给singleFlight 处理
+			reg.breaker.record(errSlowCallPanic)
+		case ctx.Err() == context.Canceled:
+			// 所有调用者都离开导致的取消不算慢函数的失败，占用的half-open 探测名额需要归还
+			reg.breaker.release(probe)
+		default:
+			reg.breaker.record(err)
+		}
+	}()
+	val, err = reg.retry(ctx, call)
+	finished = true
+	return val, err
+}
+
+// retry 按照regulation 的重试策略调用慢函数
+func (reg *regular) retry(ctx context.Context, call func(ctx context.Context) (Value, error)) (Value, error) {
+	if reg.opts.Retry != nil {
+		return withRetry(ctx, reg.opts.Retry, call)
+	}
+	return call(ctx)
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"context"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_Retry(t *testing.T) {
+	Convey("test retry regulation with backoff ", t, func() {
+		errBlip := errors.New("database blip")
+		errFatal := errors.New("bad query")
+		var calls atomic.Int32
+		ca := New(1<<20, time.Hour, nil)
+		policy := RetryPolicy{
+			Attempts:  3,
+			BaseDelay: 10 * time.Millisecond,
+			MaxDelay:  50 * time.Millisecond,
+			Retryable: func(err error) bool { return err != errFatal },
+		}
+		ca.Register("blip", 10, func() (Value, error) {
+			if calls.Inc() < 3 {
+				return nil, errBlip
+			}
+			return StringValue("ok"), nil
+		}, WithRetry(policy))
+		var fatal atomic.Int32
+		ca.Register("fatal", 10, func() (Value, error) {
+			fatal.Inc()
+			return nil, errFatal
+		}, WithRetry(policy))
+
+		v, err := ca.Get("blip")
+		So(err, ShouldBeNil)
+		So(v.(*DefaultStringValue).Value(), ShouldEqual, "ok")
+		So(calls.Load(), ShouldEqual, 3)
+
+		_, err = ca.Get("fatal")
+		So(err, ShouldEqual, errFatal)
+		So(fatal.Load(), ShouldEqual, 1)
+
+		for attempt := 1; attempt < 10; attempt++ {
+			So(backoff(&policy, attempt), ShouldBeLessThanOrEqualTo, policy.MaxDelay)
+		}
+	})
+}
+
+func TestCacheImpl_CircuitBreaker(t *testing.T) {
+	Convey("test circuit breaker of regulation ", t, func() {
+		errDown := errors.New("database is down")
+		var fail atomic.Bool
+		var calls atomic.Int32
+		loader := func() (Value, error) {
+			calls.Inc()
+			if fail.Load() {
+				return nil, errDown
+			}
+			return StringValue("ok"), nil
+		}
+		ca := New(1<<20, time.Hour, nil)
+		ca.SetErrorHandler(func(...interface{}) {})
+
+		Convey("open breaker returns ErrCircuitOpen and recovers after half-open probe ", func() {
+			ca.Register("cold", 10, loader, WithCircuitBreaker(BreakerPolicy{Failures: 2, OpenFor: 300 * time.Millisecond}))
+			fail.Store(true)
+			for i := 0; i < 2; i++ {
+				_, err := ca.Get("cold")
+				So(err, ShouldEqual, errDown)
+			}
+			_, err := ca.Get("cold")
+			So(err, ShouldEqual, ErrCircuitOpen)
+			So(calls.Load(), ShouldEqual, 2)
+			So(ca.Stats().Breakers["cold"], ShouldEqual, BreakerOpen)
+
+			time.Sleep(350 * time.Millisecond)
+			So(ca.Stats().Breakers["cold"], ShouldEqual, BreakerHalfOpen)
+			fail.Store(false)
+			v, err := ca.Get("cold")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "ok")
+			So(ca.Stats().Breakers["cold"], ShouldEqual, BreakerClosed)
+		})
+
+		Convey("open breaker keeps serving stale value ", func() {
+			ca.Register("hot", 1, loader, WithStaleFor(2), WithCircuitBreaker(BreakerPolicy{Failures: 1, OpenFor: 10 * time.Second}))
+			_, err := ca.Get("hot")
+			So(err, ShouldBeNil)
+			fail.Store(true)
+
+			// 过期之后返回旧值，后台刷新失败打开熔断器
+			time.Sleep(2100 * time.Millisecond)
+			v, err := ca.Get("hot")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "ok")
+			time.Sleep(50 * time.Millisecond)
+			So(ca.Stats().Breakers["hot"], ShouldEqual, BreakerOpen)
+
+			// 超过StaleFor 之后依然返回旧值，慢函数不会再被调用
+			time.Sleep(2500 * time.Millisecond)
+			v, err = ca.Get("hot")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "ok")
+			time.Sleep(50 * time.Millisecond)
+			So(calls.Load(), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestCacheImpl_CircuitBreakerProbe(t *testing.T) {
+	Convey("test half-open probe should always be recorded or released ", t, func() {
+		errDown := errors.New("database is down")
+		var mode atomic.String
+		loader := func(ctx context.Context) (Value, error) {
+			switch mode.Load() {
+			case "panic":
+				panic("boom")
+			case "slow":
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case "fail":
+				return nil, errDown
+			}
+			return StringValue("ok"), nil
+		}
+		ca := New(1<<20, time.Hour, nil)
+		ca.SetErrorHandler(func(...interface{}) {})
+		ca.RegisterContext("probe", 10, loader, WithCircuitBreaker(BreakerPolicy{Failures: 1, OpenFor: 200 * time.Millisecond}))
+		mode.Store("fail")
+		_, err := ca.Get("probe")
+		So(err, ShouldEqual, errDown)
+		time.Sleep(250 * time.Millisecond)
+
+		Convey("panic during probe should reopen the breaker ", func() {
+			mode.Store("panic")
+			_, err := ca.Get("probe")
+			var pe *PanicError
+			So(errors.As(err, &pe), ShouldBeTrue)
+			So(ca.Stats().Breakers["probe"], ShouldEqual, BreakerOpen)
+
+			time.Sleep(250 * time.Millisecond)
+			mode.Store("")
+			v, err := ca.Get("probe")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "ok")
+			So(ca.Stats().Breakers["probe"], ShouldEqual, BreakerClosed)
+		})
+
+		Convey("canceled probe should be given back ", func() {
+			mode.Store("slow")
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			_, err := ca.GetContext(ctx, "probe")
+			cancel()
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			time.Sleep(50 * time.Millisecond)
+			So(ca.Stats().Breakers["probe"], ShouldEqual, BreakerHalfOpen)
+
+			mode.Store("")
+			v, err := ca.Get("probe")
+			So(err, ShouldBeNil)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "ok")
+		})
+	})
+}
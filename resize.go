@@ -0,0 +1,87 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// resizeBatch 缩容的时候每次持有锁最多淘汰的entry 数量
+const resizeBatch = 1024
+
+func (c *cacheImpl) SetMaxBytes(n int64) {
+	if n <= 0 {
+		return
+	}
+	if c.governor != nil {
+		c.governor.setCeiling(n)
+	}
+	c.setMaxBytes(n)
+}
+
+// setMaxBytes 调整实际生效的maxBytes，不会修改governor 的上限
+func (c *cacheImpl) setMaxBytes(n int64) {
+	c.rw.Lock()
+	c.maxBytes = n
+	c.rw.Unlock()
+	c.shrink()
+}
+
+func (c *cacheImpl) SetMaxEntries(n int64) {
+	if n < 0 {
+		return
+	}
+	c.rw.Lock()
+	c.maxEntries = n
+	c.rw.Unlock()
+	c.shrink()
+}
+
+// shrink 分批淘汰entry 直到满足新的限制，每一批最多淘汰resizeBatch 个entry，批次之间会释放
+// 锁让读写请求进来。同一时间只有一个shrink 在执行，缩容过程中再次调整限制，正在执行的shrink
+// 会以最新的限制为准
+func (c *cacheImpl) shrink() {
+	c.rw.Lock()
+	if c.shrinking || !c.overflow() {
+		c.rw.Unlock()
+		return
+	}
+	c.shrinking = true
+	c.rw.Unlock()
+
+	var totalBytes, totalElems int64
+	for {
+		c.rw.Lock()
+		freeBytes, freeElems := c.evictN(resizeBatch)
+		done := !c.overflow() || len(c.cache)+len(c.negatives) == 0
+		if done {
+			c.shrinking = false
+		}
+		size, entries := c.nBytes, len(c.cache)
+		c.rw.Unlock()
+
+		totalBytes += freeBytes
+		totalElems += freeElems
+		c.stats.shrinkEvictions.Add(freeElems)
+		if freeElems > 0 {
+			fmt.Printf("sCache : shrinking , free %v byte ,free %v element ,current size %v ,current element %v \n\r", freeBytes, freeElems, size, entries)
+		}
+		if done {
+			fmt.Printf("sCache : shrink finished , free %v byte ,free %v element in total \n\r", totalBytes, totalElems)
+			return
+		}
+		runtime.Gosched()
+	}
+}
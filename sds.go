@@ -14,6 +14,7 @@
 package Scache
 
 import (
+	"go.uber.org/atomic"
 	"sync"
 	"time"
 )
@@ -42,6 +43,14 @@ type sds struct {
 
 	st    SDSStatus // 当前的key的状态
 	Value Value
+
+	size int // 写入时按照cache 的统计方式记录的占用大小，删除的时候以此为准
+
+	tags []string // SetWithTags 设置的标签
+
+	ns *namespace // 所属的命名空间，为nil 的时候存放在cache 的主链表中
+
+	reg atomic.Value // *regulationRef 缓存的key 对应的regulation，持有读锁的时候也会被写入
 }
 
 func NewSDS(key string, value Value, expire int) *sds {
@@ -66,6 +75,10 @@ func (s *sds) Destroy() {
 	s.expire = 0
 	s.st = SDSStatusNormal
 	s.Value = nil
+	s.size = 0
+	s.tags = nil
+	s.ns = nil
+	s.reg.Store(staleRegulationRef)
 
 	sdsPool.Put(s)
 }
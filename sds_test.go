@@ -40,3 +40,24 @@ func TestSds_Calculation(t *testing.T) {
 		fmt.Println(unsafe.Sizeof([]string{"1", "2"}))
 	})
 }
+
+func TestDeepSize(t *testing.T) {
+	Convey("test deep size of value ", t, func() {
+		Convey("string value should count header and content ", func() {
+			v := StringValue("steven")
+			So(DeepSize(v), ShouldEqual, int(unsafe.Sizeof(&DefaultStringValue{}))+int(unsafe.Sizeof(DefaultStringValue{}))+6)
+		})
+		Convey("shared pointer should be counted only once ", func() {
+			type node struct {
+				cot  []byte
+				next *node
+			}
+			n := &node{cot: make([]byte, 10, 16)}
+			n.next = n
+			So(DeepSize(n), ShouldEqual, int(unsafe.Sizeof(n))+int(unsafe.Sizeof(node{}))+16)
+		})
+		Convey("nil should be zero ", func() {
+			So(DeepSize(nil), ShouldEqual, 0)
+		})
+	})
+}
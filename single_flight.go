@@ -14,8 +14,11 @@
 package Scache
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"go.uber.org/atomic"
+	"runtime/debug"
 	"sync"
 	"time"
 )
@@ -25,11 +28,96 @@ var (
 	ErrSlowCallIsTimeOut = errors.New("sCache : slow call timeout")
 )
 
+// PanicError 慢函数发生panic 的时候，所有等待这次调用的请求都会收到同一个PanicError
+type PanicError struct {
+	Value interface{} // recover 拿到的值
+	Stack []byte      // 发生panic 时的调用栈
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("sCache : slow call panic : %v", p.Value)
+}
+
+type SingleFlight interface {
+	Get(regulation string, slowWay func() (Value, error)) (Value, bool, error)
+
+	// GetContext 同Get，ctx 结束的时候当前请求立即返回ctx.Err()，慢函数只有在所有等待的请求都
+	// 离开之后才会被取消。慢函数拿到的ctx 保留了第一个请求的ctx 中的值，但不会随着它结束
+	GetContext(ctx context.Context, regulation string, slowWay func(ctx context.Context) (Value, error)) (Value, bool, error)
+
+	// Do 同GetContext，timeout 大于0 的时候当前请求最多等待timeout，超时返回ErrSlowCallIsTimeOut，
+	// 返回的结果中包含这次调用是否被共享以及等待的请求数量
+	Do(ctx context.Context, regulation string, timeout time.Duration, slowWay func(ctx context.Context) (Value, error)) FlightResult[Value]
+
+	// DoChan 同Do，不阻塞调用者，结果通过channel 返回
+	DoChan(ctx context.Context, regulation string, slowWay func(ctx context.Context) (Value, error)) <-chan FlightResult[Value]
+
+	// Forget 丢弃正在执行的调用，之后的请求会重新调用慢函数，已经在等待的请求依然拿到原来的结果
+	Forget(regulation string)
+}
+
+// 这里是一个分布式锁的快捷实现 ， short for distributed lock
+type defaultSingleFlight struct {
+	group *SingleFlightGroup[Value]
+
+	// 超时时间，如果存在update方法特别慢，超过了expireTime的最大等待时间，那么
+	// 就会返回超时错误
+	MaxWaitTime int
+}
+
+func NewSingleFlight(maxWaitTime int) SingleFlight {
+	l := &defaultSingleFlight{
+		group:       NewSingleFlightGroup[Value](time.Duration(maxWaitTime) * time.Second),
+		MaxWaitTime: maxWaitTime,
+	}
+	return l
+}
+
+func (l *defaultSingleFlight) Get(topicName string, slow func() (Value, error)) (Value, bool /* is slow path*/, error) {
+	if slow == nil {
+		return nil, false, ErrInValidParam
+	}
+	return l.GetContext(context.Background(), topicName, func(ctx context.Context) (Value, error) {
+		return slow()
+	})
+}
+
+func (l *defaultSingleFlight) GetContext(ctx context.Context, topicName string, slow func(ctx context.Context) (Value, error)) (Value, bool /* is slow path*/, error) {
+	res := l.Do(ctx, topicName, 0, slow)
+	return res.Val, res.claimed, res.Err
+}
+
+func (l *defaultSingleFlight) Do(ctx context.Context, topicName string, timeout time.Duration, slow func(ctx context.Context) (Value, error)) FlightResult[Value] {
+	if topicName == "" || slow == nil || ctx == nil {
+		return FlightResult[Value]{Err: ErrInValidParam}
+	}
+	return l.group.Do(ctx, topicName, timeout, slow)
+}
+
+func (l *defaultSingleFlight) DoChan(ctx context.Context, topicName string, slow func(ctx context.Context) (Value, error)) <-chan FlightResult[Value] {
+	if topicName == "" || slow == nil || ctx == nil {
+		ch := make(chan FlightResult[Value], 1)
+		ch <- FlightResult[Value]{Err: ErrInValidParam}
+		return ch
+	}
+	return l.group.DoChan(ctx, topicName, slow)
+}
+
+func (l *defaultSingleFlight) Forget(topicName string) {
+	l.group.Forget(topicName)
+}
+
+// Element 一次慢函数调用的结果
+//
+// Deprecated: singleFlight 的结果通过 FlightResult 返回，Element 只是为了兼容保留
 type Element struct {
 	value Value
 	err   error
 }
 
+// Topic 一个正在执行的慢函数以及订阅了它的请求
+//
+// Deprecated: 使用 SingleFlightGroup，Topic 只是为了兼容保留，不再被singleFlight 使用
 type Topic struct {
 	// 保护notify的用户切片集合
 	rw sync.RWMutex
@@ -42,13 +130,9 @@ type Topic struct {
 }
 
 func (o *Topic) publish(value *Element) {
-	if len(o.notify) == 0 {
-		return
-	}
 	o.rw.Lock()
 	for _, v := range o.notify {
-		tev := v
-		tev <- value
+		v <- value
 	}
 	o.rw.Unlock()
 }
@@ -59,115 +143,208 @@ func (o *Topic) subscribe(notify chan *Element) {
 	o.rw.Unlock()
 }
 
-type SingleFlight interface {
-	Get(regulation string, slowWay func() (Value, error)) (Value, bool, error)
+// FlightResult 一次singleFlight 调用的结果
+type FlightResult[T any] struct {
+	Val T
+	Err error
+
+	// Shared 结果是否同时返回给了多个请求
+	Shared bool
+
+	// Waiters 加入过这次调用的请求数量，包含发起调用的请求以及中途离开的请求
+	Waiters int
+
+	// 同一个结果会发给所有的请求，只有第一个拿到结果的请求为true，由它负责存储
+	claimed bool
 }
 
-// 这里是一个分布式锁的快捷实现 ， short for distributed lock
-type defaultSingleFlight struct {
-	rw *sync.RWMutex
+// SingleFlightGroup 泛型的singleFlight，同一个key 同一时间只会有一个慢函数在执行，其他的请求等待
+// 这次调用的结果。零值可以直接使用
+type SingleFlightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
 
-	// 这里是一个观察者，用户可以订阅，内部调用push 方法,用户请求到内部大概率会被
-	// 阻塞到observer 当中，最好使
-	obs map[string]*Topic
+	// Timeout 慢函数的最长执行时间，超过之后所有等待的请求都会收到ErrSlowCallIsTimeOut，为0的
+	// 时候不限制
+	Timeout time.Duration
+}
 
-	// 超时时间，如果存在update方法特别慢，超过了expireTime的最大等待时间，那么
-	// 就会返回超时错误
-	MaxWaitTime int
+// flightCall 一次正在执行的调用
+type flightCall[T any] struct {
+	// 调用结束之后关闭，之后val、err、waiters 不会再被修改
+	done    chan struct{}
+	val     T
+	err     error
+	waiters int
+
+	// 由SingleFlightGroup 的锁保护，refs 是还在等待结果的请求数量，降为0的时候通过cancel 取消慢函数
+	refs   int
+	joined int
+	cancel context.CancelFunc
+
+	claimed atomic.Bool
 }
 
-func NewSingleFlight(maxWaitTime int) SingleFlight {
-	l := &defaultSingleFlight{
-		rw:          &sync.RWMutex{},
-		obs:         map[string]*Topic{},
-		MaxWaitTime: maxWaitTime,
+func NewSingleFlightGroup[T any](timeout time.Duration) *SingleFlightGroup[T] {
+	return &SingleFlightGroup[T]{
+		calls:   map[string]*flightCall[T]{},
+		Timeout: timeout,
 	}
-	return l
 }
 
-func (l *defaultSingleFlight) notify(topicName string, no *Element) {
-	l.rw.Lock()
-	defer l.rw.Unlock()
-	// 将这步操作从最后放在第一排
-	v, ok := l.obs[topicName]
-	if ok {
-		v.publish(no)
+// Do 执行或者等待key 对应的调用，ctx 结束的时候当前请求立即返回ctx.Err()，慢函数只有在所有等待
+// 的请求都离开之后才会被取消。慢函数拿到的ctx 保留了第一个请求的ctx 中的值，但不会随着它结束。
+// timeout 大于0 的时候当前请求最多等待timeout，超时返回ErrSlowCallIsTimeOut
+func (g *SingleFlightGroup[T]) Do(ctx context.Context, key string, timeout time.Duration, fn func(ctx context.Context) (T, error)) FlightResult[T] {
+	if err := ctx.Err(); err != nil {
+		return FlightResult[T]{Err: err}
+	}
+	wait := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	c := g.join(ctx, key, fn)
+	select {
+	case <-c.done:
+		return c.result()
+	case <-wait.Done():
+		// 结果和ctx 同时就绪的时候优先返回结果
+		select {
+		case <-c.done:
+			return c.result()
+		default:
+		}
+		g.leave(key, c)
+		if ctx.Err() == nil {
+			return FlightResult[T]{Err: ErrSlowCallIsTimeOut}
+		}
+		return FlightResult[T]{Err: ctx.Err()}
 	}
-	delete(l.obs, topicName)
 }
 
-func (l *defaultSingleFlight) setNx(topicName string, slow func() (Value, error)) (chan *Element, error) {
-	l.rw.Lock()
-	defer l.rw.Unlock()
-	if val, ok := l.obs[topicName]; ok {
-		ch := make(chan *Element, 1)
-		val.subscribe(ch)
-		return ch, nil
+// DoChan 同Do，结果通过channel 返回，channel 带有缓冲，调用者不读取也不会阻塞
+func (g *SingleFlightGroup[T]) DoChan(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) <-chan FlightResult[T] {
+	ch := make(chan FlightResult[T], 1)
+	go func() {
+		ch <- g.Do(ctx, key, 0, fn)
+	}()
+	return ch
+}
+
+// Forget 丢弃key 对应的正在执行的调用，之后的请求会重新调用慢函数，已经在等待的请求依然拿到原来的结果
+func (g *SingleFlightGroup[T]) Forget(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.calls, key)
+}
+
+// join 加入key 对应的调用，调用不存在的时候创建调用并在后台执行慢函数
+func (g *SingleFlightGroup[T]) join(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) *flightCall[T] {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall[T]{}
+	}
+	if c, ok := g.calls[key]; ok {
+		c.refs++
+		c.joined++
+		return c
+	}
+	var loadCtx context.Context
+	var cancel context.CancelFunc
+	if g.Timeout > 0 {
+		loadCtx, cancel = context.WithTimeout(detach(ctx), g.Timeout)
 	} else {
-		// 将内容注册到topic管理中心中
-		ob := &Topic{
-			notify: []chan *Element{},
-			OnCall: slow,
-		}
-		l.obs[topicName] = ob
-		return nil, nil
+		loadCtx, cancel = context.WithCancel(detach(ctx))
+	}
+	c := &flightCall[T]{
+		done:   make(chan struct{}),
+		refs:   1,
+		joined: 1,
+		cancel: cancel,
 	}
+	g.calls[key] = c
+	go g.run(loadCtx, key, c, fn)
+	return c
 }
 
-func (l *defaultSingleFlight) slowWay(topicName string, slow func() (Value, error)) (Value, bool, error) {
-	v, err := l.call(slow)
-	if err != nil {
-		return nil, false, err
+// leave 请求不再等待结果，最后一个请求离开的时候取消慢函数并删除调用
+func (g *SingleFlightGroup[T]) leave(key string, c *flightCall[T]) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c.refs--
+	if c.refs > 0 {
+		return
 	}
+	c.cancel()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
 
-	niy := &Element{
-		value: v,
-		err:   err,
+// run 执行慢函数，失败、panic 和超时都会作为结果通知所有等待的请求，并且总是删除调用
+func (g *SingleFlightGroup[T]) run(ctx context.Context, key string, c *flightCall[T], fn func(ctx context.Context) (T, error)) {
+	defer c.cancel()
+	val, err := g.call(ctx, fn)
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
 	}
-	l.notify(topicName, niy)
-	return v, true, err
+	c.val, c.err, c.waiters = val, err, c.joined
+	g.mu.Unlock()
+	close(c.done)
 }
 
-func (l *defaultSingleFlight) call(slow func() (Value, error)) (Value, error) {
-	t := time.NewTicker(time.Duration(l.MaxWaitTime) * time.Second)
-	ch := make(chan *Element)
+func (g *SingleFlightGroup[T]) call(ctx context.Context, fn func(ctx context.Context) (T, error)) (val T, err error) {
+	type result struct {
+		val T
+		err error
+	}
+	// 慢函数没有响应ctx 的时候依然需要能够写入结果后退出
+	ch := make(chan result, 1)
 	go func() {
 		defer func() {
-			if err := recover(); err != nil {
-				// todo 记录好err
-				fmt.Println(err)
+			if r := recover(); r != nil {
+				ch <- result{err: &PanicError{Value: r, Stack: debug.Stack()}}
 			}
 		}()
 		// 2 .执行慢操作,此操作不占用锁
-		val, err := slow()
-		niy := &Element{
-			value: val,
-			err:   err,
-		}
-		ch <- niy
+		v, err := fn(ctx)
+		ch <- result{val: v, err: err}
 	}()
 	select {
-	case <-t.C:
-		return nil, ErrSlowCallIsTimeOut
-	case data := <-ch:
-		return data.value, data.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return val, ErrSlowCallIsTimeOut
+		}
+		return val, ctx.Err()
+	case r := <-ch:
+		return r.val, r.err
 	}
 }
 
-func (l *defaultSingleFlight) Get(topicName string, slow func() (Value, error)) (Value, bool /* is slow path*/, error) {
-	if topicName == "" || slow == nil {
-		return nil, false, ErrInValidParam
+func (c *flightCall[T]) result() FlightResult[T] {
+	return FlightResult[T]{
+		Val:     c.val,
+		Err:     c.err,
+		Shared:  c.waiters > 1,
+		Waiters: c.waiters,
+		claimed: c.claimed.CAS(false, true),
 	}
+}
 
-	// 对标志位进行加锁操作，标志位设置成功，就进入slowWay 如果标志位设置失败就进入
-	// waitWay, 这里需要注意临界值的判断，所以对资源颗粒度相对较小，要求比较高
-	ch, err := l.setNx(topicName, slow)
-	if err != nil {
-		return nil, false, err
-	}
-	if ch != nil {
-		data := <-ch
-		return data.value, false, data.err
-	}
-	return l.slowWay(topicName, slow)
+// detachedContext 保留父ctx 中的值，但是不继承父ctx 的deadline 和取消
+type detachedContext struct {
+	parent context.Context
 }
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (d detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (d detachedContext) Done() <-chan struct{}             { return nil }
+func (d detachedContext) Err() error                        { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
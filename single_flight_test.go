@@ -14,6 +14,8 @@
 package Scache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.uber.org/atomic"
@@ -113,3 +115,203 @@ func TestDefaultSingleFlight_GetTimeOut(t *testing.T) {
 		So(in.Load(), ShouldEqual, parallel)
 	})
 }
+
+func TestDefaultSingleFlight_GetContext(t *testing.T) {
+	Convey("测试调用者通过ctx 放弃等待", t, func() {
+		ob := NewSingleFlight(10)
+		Convey("部分调用者离开的时候慢函数继续执行", func() {
+			var calls atomic.Int32
+			slow := func(ctx context.Context) (Value, error) {
+				calls.Inc()
+				select {
+				case <-time.After(500 * time.Millisecond):
+					return StringValue("done"), nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			errs := make(chan error, 1)
+			go func() {
+				_, _, err := ob.GetContext(ctx, "partial", slow)
+				errs <- err
+			}()
+			time.Sleep(10 * time.Millisecond)
+			start := time.Now()
+			v, slowPath, err := ob.GetContext(context.Background(), "partial", slow)
+			So(err, ShouldBeNil)
+			So(slowPath, ShouldBeTrue)
+			So(v.(*DefaultStringValue).Value(), ShouldEqual, "done")
+			So(time.Since(start), ShouldBeGreaterThan, 400*time.Millisecond)
+			So(errors.Is(<-errs, context.DeadlineExceeded), ShouldBeTrue)
+			So(calls.Load(), ShouldEqual, 1)
+		})
+
+		Convey("所有调用者离开的时候取消慢函数", func() {
+			canceled := make(chan struct{})
+			type traceKey struct{}
+			slow := func(ctx context.Context) (Value, error) {
+				if ctx.Value(traceKey{}) != "trace" {
+					return nil, ErrInValidParam
+				}
+				<-ctx.Done()
+				close(canceled)
+				return nil, ctx.Err()
+			}
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), traceKey{}, "trace"))
+			done := make(chan error, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					_, _, err := ob.GetContext(ctx, "all", slow)
+					done <- err
+				}()
+			}
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			So(<-done, ShouldEqual, context.Canceled)
+			So(<-done, ShouldEqual, context.Canceled)
+			select {
+			case <-canceled:
+			case <-time.After(time.Second):
+				So("slow call is not canceled", ShouldBeEmpty)
+			}
+		})
+	})
+}
+
+func TestDefaultSingleFlight_GetFailure(t *testing.T) {
+	Convey("测试失败、panic 和超时会通知所有等待的请求", t, func() {
+		ob := NewSingleFlight(1)
+		run := func(topic string, slow func() (Value, error)) []error {
+			var parallel = 10
+			errs := make(chan error, parallel)
+			for i := 0; i < parallel; i++ {
+				go func() {
+					_, _, err := ob.Get(topic, slow)
+					errs <- err
+				}()
+			}
+			var res []error
+			for i := 0; i < parallel; i++ {
+				select {
+				case err := <-errs:
+					res = append(res, err)
+				case <-time.After(3 * time.Second):
+					return res
+				}
+			}
+			return res
+		}
+
+		Convey("慢函数返回错误", func() {
+			errBackend := errors.New("backend is down")
+			var calls atomic.Int32
+			slow := func() (Value, error) {
+				calls.Inc()
+				time.Sleep(200 * time.Millisecond)
+				return nil, errBackend
+			}
+			errs := run("error", slow)
+			So(len(errs), ShouldEqual, 10)
+			for _, err := range errs {
+				So(err, ShouldEqual, errBackend)
+			}
+			So(calls.Load(), ShouldEqual, 1)
+
+			// topic 已经被清理，之后的请求会重新调用慢函数
+			_, _, err := ob.Get("error", slow)
+			So(err, ShouldEqual, errBackend)
+			So(calls.Load(), ShouldEqual, 2)
+		})
+
+		Convey("慢函数panic", func() {
+			var calls atomic.Int32
+			slow := func() (Value, error) {
+				calls.Inc()
+				time.Sleep(200 * time.Millisecond)
+				panic("boom")
+			}
+			errs := run("panic", slow)
+			So(len(errs), ShouldEqual, 10)
+			for _, err := range errs {
+				var pe *PanicError
+				So(errors.As(err, &pe), ShouldBeTrue)
+				So(pe.Value, ShouldEqual, "boom")
+				So(string(pe.Stack), ShouldContainSubstring, "TestDefaultSingleFlight_GetFailure")
+			}
+			So(calls.Load(), ShouldEqual, 1)
+		})
+
+		Convey("慢函数超时", func() {
+			var calls atomic.Int32
+			slow := func() (Value, error) {
+				calls.Inc()
+				time.Sleep(1500 * time.Millisecond)
+				return StringValue("late"), nil
+			}
+			errs := run("timeout", slow)
+			So(len(errs), ShouldEqual, 10)
+			for _, err := range errs {
+				So(err, ShouldEqual, ErrSlowCallIsTimeOut)
+			}
+			So(calls.Load(), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestSingleFlightGroup(t *testing.T) {
+	Convey("测试泛型singleFlight", t, func() {
+		g := NewSingleFlightGroup[int](time.Second)
+		var calls atomic.Int32
+		slow := func(ctx context.Context) (int, error) {
+			calls.Inc()
+			time.Sleep(200 * time.Millisecond)
+			return 42, nil
+		}
+
+		Convey("结果报告是否共享以及等待的请求数量", func() {
+			var parallel = 5
+			results := make(chan FlightResult[int], parallel)
+			for i := 0; i < parallel; i++ {
+				go func() {
+					results <- g.Do(context.Background(), "shared", 0, slow)
+				}()
+			}
+			claimed := 0
+			for i := 0; i < parallel; i++ {
+				res := <-results
+				So(res.Err, ShouldBeNil)
+				So(res.Val, ShouldEqual, 42)
+				So(res.Shared, ShouldBeTrue)
+				So(res.Waiters, ShouldEqual, parallel)
+				if res.claimed {
+					claimed++
+				}
+			}
+			So(claimed, ShouldEqual, 1)
+			So(calls.Load(), ShouldEqual, 1)
+
+			res := <-g.DoChan(context.Background(), "shared", slow)
+			So(res.Val, ShouldEqual, 42)
+			So(res.Shared, ShouldBeFalse)
+			So(res.Waiters, ShouldEqual, 1)
+			So(calls.Load(), ShouldEqual, 2)
+		})
+
+		Convey("单个请求的超时", func() {
+			res := g.Do(context.Background(), "timeout", 50*time.Millisecond, slow)
+			So(res.Err, ShouldEqual, ErrSlowCallIsTimeOut)
+		})
+
+		Convey("Forget 之后重新调用慢函数", func() {
+			first := g.DoChan(context.Background(), "forget", slow)
+			time.Sleep(50 * time.Millisecond)
+			g.Forget("forget")
+			second := g.DoChan(context.Background(), "forget", slow)
+			So((<-first).Val, ShouldEqual, 42)
+			So((<-second).Val, ShouldEqual, 42)
+			So(calls.Load(), ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	"go.uber.org/atomic"
+	"time"
+)
+
+// Stats 是cache 某一时刻的统计数据快照
+type Stats struct {
+	Entries    int64 // 当前的entry 数量，包含被标记删除但还未真正释放的entry
+	MaxEntries int64 // 最大的entry 数量，0 表示不限制
+	Bytes      int64 // 当前统计的占用字节数
+	MaxBytes   int64 // 最大的占用字节数
+	Evictions  int64 // 因为超出限制被淘汰的entry 数量
+
+	Shrinking       bool  // 当前是否正在分批缩容
+	ShrinkEvictions int64 // 缩容过程中累计淘汰的entry 数量
+
+	MemoryPressure float64 // governor 最近一次采样的内存使用率，没有开启governor 的时候为0
+
+	Rejections int64 // 被准入策略拒绝的写入次数
+
+	OffHeapEntries   int64 // 字节存储模式中的entry 数量
+	OffHeapBytes     int64 // 字节存储模式中已经使用的字节数，包含还未回收的已删除entry
+	OffHeapEvictions int64 // 字节存储模式中因为空间不足被淘汰的entry 数量
+
+	CompressIn     int64         // 被压缩存储的值压缩之前的总字节数
+	CompressOut    int64         // 被压缩存储的值压缩之后的总字节数
+	CompressRatio  float64       // CompressOut / CompressIn，越小压缩效果越好，没有压缩过的时候为0
+	CompressTime   time.Duration // 压缩累计花费的CPU 时间
+	DecompressTime time.Duration // 解压累计花费的CPU 时间
+
+	StaleServes   int64 // regulation 过期之后在stale 窗口内返回旧值的次数
+	RefreshAheads int64 // regulation 过期之前被提前刷新的次数
+	NegativeHits  int64 // 命中负缓存的次数
+	HostHandoffs  int64 // 从同一台机器上其他进程写入的结果文件中拿到regulation 结果的次数
+
+	Breakers map[string]BreakerState // 开启了熔断的regulation 以及熔断器的状态
+
+	Loader       LoaderStats            // 慢函数全局并发限制的统计，没有开启的时候为零值
+	LoaderGroups map[string]LoaderStats // 每个分组的并发限制的统计
+}
+
+// stats 内部的计数器，计数器不依赖cache 的锁
+type stats struct {
+	evictions       atomic.Int64
+	shrinkEvictions atomic.Int64
+	rejections      atomic.Int64
+
+	compressIn      atomic.Int64
+	compressOut     atomic.Int64
+	compressNanos   atomic.Int64
+	decompressNanos atomic.Int64
+
+	staleServes   atomic.Int64
+	refreshAheads atomic.Int64
+	negativeHits  atomic.Int64
+}
+
+func (c *cacheImpl) Stats() Stats {
+	var pressure float64
+	if c.governor != nil {
+		pressure = c.governor.Pressure()
+	}
+	var ratio float64
+	if in := c.stats.compressIn.Load(); in > 0 {
+		ratio = float64(c.stats.compressOut.Load()) / float64(in)
+	}
+	var offEntries, offBytes, offEvictions int64
+	if c.offHeap != nil {
+		offEntries, offBytes, offEvictions = c.offHeap.stat()
+	}
+	loader, loaderGroups := c.bulkheads.stats()
+	var handoffs int64
+	if c.hostFlight != nil {
+		handoffs = c.hostFlight.handoffs.Load()
+	}
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return Stats{
+		Entries:    int64(len(c.cache)),
+		MaxEntries: c.maxEntries,
+		Bytes:      c.nBytes,
+		MaxBytes:   c.maxBytes,
+		Evictions:  c.stats.evictions.Load(),
+
+		Shrinking:       c.shrinking,
+		ShrinkEvictions: c.stats.shrinkEvictions.Load(),
+
+		MemoryPressure: pressure,
+
+		Rejections: c.stats.rejections.Load(),
+
+		OffHeapEntries:   offEntries,
+		OffHeapBytes:     offBytes,
+		OffHeapEvictions: offEvictions,
+
+		CompressIn:     c.stats.compressIn.Load(),
+		CompressOut:    c.stats.compressOut.Load(),
+		CompressRatio:  ratio,
+		CompressTime:   time.Duration(c.stats.compressNanos.Load()),
+		DecompressTime: time.Duration(c.stats.decompressNanos.Load()),
+
+		StaleServes:   c.stats.staleServes.Load(),
+		RefreshAheads: c.stats.refreshAheads.Load(),
+		NegativeHits:  c.stats.negativeHits.Load(),
+		HostHandoffs:  handoffs,
+
+		Breakers: c.regularManger.Breakers(),
+
+		Loader:       loader,
+		LoaderGroups: loaderGroups,
+	}
+}
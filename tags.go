@@ -0,0 +1,142 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import "time"
+
+func (c *cacheImpl) SetWithTags(key string, value Value, ttl int, tags ...string) error {
+	if value == nil || key == "" || ttl < 0 {
+		return ErrInValidParam
+	}
+	return c.setTagged(key, value, ttl, uniqueTags(tags), false)
+}
+
+// InvalidateTag 通过fakeDel 将带有tag 的key 标记为删除，tag 同时从索引以及每个key 的标签中移除，
+// 其他标签的索引清理在RealDel 中进行
+func (c *cacheImpl) InvalidateTag(tag string) int {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	keys, ok := c.tags[tag]
+	if !ok {
+		return 0
+	}
+	counter := 0
+	for key := range keys {
+		if ele, ok := c.getElem(key); ok {
+			sd := ele.Value.(*sds)
+			sd.tags = dropTag(sd.tags, tag)
+			if sd.Status() == SDSStatusNormal {
+				c.fakeDel(sd)
+				counter++
+			}
+		}
+	}
+	delete(c.tags, tag)
+	return counter
+}
+
+func (c *cacheImpl) TagCount(tag string) int {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.tagCount(c.tags[tag], time.Now().Unix())
+}
+
+func (c *cacheImpl) Tags() map[string]int {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	now := time.Now().Unix()
+	res := make(map[string]int, len(c.tags))
+	for tag, keys := range c.tags {
+		if n := c.tagCount(keys, now); n > 0 {
+			res[tag] = n
+		}
+	}
+	return res
+}
+
+// tagCount 计算keys 中还可以访问的key 的数量，被标记删除或者已经过期的不计算在内
+func (c *cacheImpl) tagCount(keys map[string]struct{}, now int64) int {
+	counter := 0
+	for key := range keys {
+		ele, ok := c.getElem(key)
+		if !ok {
+			continue
+		}
+		sd := ele.Value.(*sds)
+		if sd.Status() == SDSStatusNormal && (sd.expire == 0 || sd.expire >= now) {
+			counter++
+		}
+	}
+	return counter
+}
+
+// tag 将sd 加入标签索引，并发不安全
+func (c *cacheImpl) tag(sd *sds) {
+	if len(sd.tags) == 0 {
+		return
+	}
+	if c.tags == nil {
+		c.tags = map[string]map[string]struct{}{}
+	}
+	for _, t := range sd.tags {
+		keys, ok := c.tags[t]
+		if !ok {
+			keys = map[string]struct{}{}
+			c.tags[t] = keys
+		}
+		keys[sd.key] = struct{}{}
+	}
+}
+
+// untag 将sd 从标签索引中移除，标签下没有key 的时候删除标签，并发不安全
+func (c *cacheImpl) untag(sd *sds) {
+	for _, t := range sd.tags {
+		if keys, ok := c.tags[t]; ok {
+			delete(keys, sd.key)
+			if len(keys) == 0 {
+				delete(c.tags, t)
+			}
+		}
+	}
+}
+
+// dropTag 返回去掉tag 之后的标签，不修改原来的切片
+func dropTag(tags []string, tag string) []string {
+	res := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t != tag {
+			res = append(res, t)
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+func uniqueTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, t := range tags {
+		if _, ok := seen[t]; ok || t == "" {
+			continue
+		}
+		seen[t] = struct{}{}
+		res = append(res, t)
+	}
+	return res
+}
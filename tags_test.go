@@ -0,0 +1,84 @@
+/*
+ * Copyright 2022 steven
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package Scache
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestCacheImpl_Tags(t *testing.T) {
+	Convey("test tag based invalidation ", t, func() {
+		var deleted []string
+		ca := New(1<<20, 10*time.Second, func(key string, value Value) {
+			deleted = append(deleted, key)
+		}).(*cacheImpl)
+		ca.SetWithTags("listing:1", StringValue("l1"), 0, "product:1", "listing")
+		ca.SetWithTags("search:phone", StringValue("s1"), 0, "product:1", "product:2")
+		ca.SetWithTags("recommend:2", StringValue("r2"), 0, "product:2")
+		ca.Set("plain", StringValue("p"))
+
+		So(ca.TagCount("product:1"), ShouldEqual, 2)
+		So(ca.Tags(), ShouldResemble, map[string]int{"product:1": 2, "product:2": 2, "listing": 1})
+
+		Convey("invalidate tag should fake delete every key carrying it ", func() {
+			So(ca.InvalidateTag("product:1"), ShouldEqual, 2)
+			So(deleted, ShouldHaveLength, 2)
+			v, _ := ca.Get("listing:1")
+			So(v, ShouldBeNil)
+			v, _ = ca.Get("recommend:2")
+			So(v, ShouldNotBeNil)
+			So(ca.TagCount("product:1"), ShouldEqual, 0)
+			So(ca.TagCount("product:2"), ShouldEqual, 1)
+
+			Convey("real delete should clean up the index ", func() {
+				ca.RealDel()
+				So(ca.tags, ShouldResemble, map[string]map[string]struct{}{
+					"product:2": {"recommend:2": {}},
+				})
+			})
+		})
+
+		Convey("overwrite with tags should replace the tags ", func() {
+			ca.SetWithTags("listing:1", StringValue("l2"), 0, "listing")
+			So(ca.TagCount("listing"), ShouldEqual, 1)
+			So(ca.TagCount("product:1"), ShouldEqual, 1)
+		})
+
+		Convey("plain overwrite should keep the tags ", func() {
+			ca.Set("listing:1", StringValue("l2"))
+			So(ca.TagCount("listing"), ShouldEqual, 1)
+			So(ca.TagCount("product:1"), ShouldEqual, 2)
+			So(ca.cache["listing:1"].Value.(*sds).tags, ShouldResemble, []string{"product:1", "listing"})
+		})
+
+		Convey("invalidated tag should be removed from every key ", func() {
+			ca.InvalidateTag("product:2")
+			So(ca.cache["search:phone"].Value.(*sds).tags, ShouldResemble, []string{"product:1"})
+			So(ca.cache["recommend:2"].Value.(*sds).tags, ShouldBeNil)
+			ca.RealDel()
+			So(ca.tags, ShouldResemble, map[string]map[string]struct{}{
+				"listing":   {"listing:1": {}},
+				"product:1": {"listing:1": {}},
+			})
+		})
+
+		Convey("eviction should clean up the index ", func() {
+			ca.SetMaxEntries(1)
+			So(ca.Tags(), ShouldBeEmpty)
+			So(ca.tags, ShouldBeEmpty)
+		})
+	})
+}